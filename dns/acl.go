@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+
+	logger "github.com/jodydadescott/jody-go-logger"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// access is the access control for recursion and local answers. A nil acl
+// allows every client.
+type access struct {
+	recursion *acl
+	local     *acl
+}
+
+func newAccess(config *AccessConfig) *access {
+
+	if config == nil {
+		return nil
+	}
+
+	return &access{
+		recursion: newACL(config.Recursion),
+		local:     newACL(config.Local),
+	}
+}
+
+// acl is a list of allowed and denied networks. Deny takes precedence and an
+// empty allow list allows every client that is not denied.
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newACL(config *ACLConfig) *acl {
+
+	if config == nil {
+		return nil
+	}
+
+	a := &acl{}
+
+	for _, v := range config.Allow {
+		a.allow = append(a.allow, parseNetwork(v))
+	}
+
+	for _, v := range config.Deny {
+		a.deny = append(a.deny, parseNetwork(v))
+	}
+
+	return a
+}
+
+// parseNetwork parses a CIDR or a single IP
+func parseNetwork(v string) *net.IPNet {
+
+	if _, network, err := net.ParseCIDR(v); err == nil {
+		return network
+	}
+
+	ip := net.ParseIP(v)
+	if ip == nil {
+		panic(fmt.Sprintf("access %s is not a valid CIDR or IP", v))
+	}
+
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func (t *acl) allowed(ip net.IP) bool {
+
+	if t == nil {
+		return true
+	}
+
+	// A client without an IP can not be matched so it is only allowed if
+	// there are no rules
+	if ip == nil {
+		return len(t.allow) <= 0 && len(t.deny) <= 0
+	}
+
+	for _, network := range t.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(t.allow) <= 0 {
+		return true
+	}
+
+	for _, network := range t.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsRecursion returns true if names may be forwarded for the client
+func (t *Server) allowsRecursion(w dns.ResponseWriter) bool {
+	return t.checkAccess(w, "recursion", func(a *access) *acl { return a.recursion })
+}
+
+// allowsLocalAnswers returns true if the client may be answered from the local
+// domains
+func (t *Server) allowsLocalAnswers(w dns.ResponseWriter) bool {
+	return t.checkAccess(w, "local answers", func(a *access) *acl { return a.local })
+}
+
+// checkAccess checks the global rules and then the rules of the listener the
+// query arrived on
+func (t *Server) checkAccess(w dns.ResponseWriter, kind string, get func(*access) *acl) bool {
+
+	ip := addrIP(w.RemoteAddr())
+
+	allowed := true
+
+	if t.access != nil && !get(t.access).allowed(ip) {
+		allowed = false
+	}
+
+	if allowed {
+		for _, listener := range t.listeners {
+			a := t.listenerAccess[listener]
+			if a == nil || !listenerMatches(listener, w.LocalAddr()) {
+				continue
+			}
+			if !get(a).allowed(ip) {
+				allowed = false
+			}
+			break
+		}
+	}
+
+	if !allowed && logger.Trace {
+		zap.L().Debug(fmt.Sprintf("Client %s is not allowed %s", w.RemoteAddr().String(), kind))
+	}
+
+	return allowed
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/jodydadescott/home-dns-server/types/proto"
+)
+
+func TestACLAllowed(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		config  *ACLConfig
+		ip      string
+		allowed bool
+	}{
+		{"no rules", &ACLConfig{}, "192.0.2.1", true},
+		{"no rules without IP", &ACLConfig{}, "", true},
+		{"allowed network", &ACLConfig{Allow: []string{"192.168.0.0/16"}}, "192.168.1.1", true},
+		{"not allowed network", &ACLConfig{Allow: []string{"192.168.0.0/16"}}, "10.0.0.1", false},
+		{"allowed IP", &ACLConfig{Allow: []string{"10.0.0.1"}}, "10.0.0.1", true},
+		{"not allowed IP", &ACLConfig{Allow: []string{"10.0.0.1"}}, "10.0.0.2", false},
+		{"denied network", &ACLConfig{Deny: []string{"192.168.66.0/24"}}, "192.168.66.1", false},
+		{"not denied network", &ACLConfig{Deny: []string{"192.168.66.0/24"}}, "192.168.1.1", true},
+		{"deny wins", &ACLConfig{Allow: []string{"192.168.0.0/16"}, Deny: []string{"192.168.66.0/24"}}, "192.168.66.1", false},
+		{"IPv6 network", &ACLConfig{Allow: []string{"2001:db8::/32"}}, "2001:db8::1", true},
+		{"IPv6 IP", &ACLConfig{Deny: []string{"2001:db8::1"}}, "2001:db8::1", false},
+		{"IPv4 rule for IPv6 client", &ACLConfig{Allow: []string{"192.168.0.0/16"}}, "2001:db8::1", false},
+		{"rules without IP", &ACLConfig{Deny: []string{"192.168.66.0/24"}}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if v := newACL(test.config).allowed(net.ParseIP(test.ip)); v != test.allowed {
+				t.Fatalf("expected allowed %v, got %v", test.allowed, v)
+			}
+		})
+	}
+
+	if !newACL(nil).allowed(nil) {
+		t.Fatal("expected nil acl to allow every client")
+	}
+}
+
+func TestACLInvalid(t *testing.T) {
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for invalid network")
+		}
+	}()
+
+	newACL(&ACLConfig{Allow: []string{"192.168.0.0/33"}})
+}
+
+func TestAccess(t *testing.T) {
+
+	nameserver := testNameserver(t, testAnswer("203.0.113.1"))
+
+	config := &Config{
+		Nameservers: []*NetPort{nameserver},
+		Access: &AccessConfig{
+			Recursion: &ACLConfig{
+				Allow: []string{"192.168.0.0/16"},
+				Deny:  []string{"192.168.66.0/24"},
+			},
+		},
+		Listeners: []*NetPort{
+			{IP: "127.0.0.1", Port: 53, Proto: proto.UDP},
+			{IP: "0.0.0.0", Port: 53, Proto: proto.TCP, Access: &AccessConfig{
+				Local: &ACLConfig{Deny: []string{"192.168.1.66"}},
+			}},
+			{IP: "127.0.0.1", Port: 5353, Proto: proto.UDP, Access: &AccessConfig{
+				Recursion: &ACLConfig{Deny: []string{"0.0.0.0/0"}},
+			}},
+		},
+	}
+
+	for _, provider := range testProviders(testDomain()) {
+		config.AddProvider(provider)
+	}
+
+	s := testServer(t, config)
+
+	// The TCP listener is bound to every address so queries arrive on the
+	// address of the interface
+	wildcard := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 53}
+	noRecursion := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+
+	tests := []struct {
+		name      string
+		localAddr net.Addr
+		client    string
+		qname     string
+		answer    string
+	}{
+		{"local answer", testLocalAddr, "192.168.1.50", "host1.home.", "192.168.1.1"},
+		{"recursion", testLocalAddr, "192.168.1.50", "www.example.com.", "203.0.113.1"},
+		{"local answer outside recursion rules", testLocalAddr, "10.1.1.1", "host1.home.", "192.168.1.1"},
+		{"recursion not allowed", testLocalAddr, "10.1.1.1", "www.example.com.", ""},
+		{"recursion denied", testLocalAddr, "192.168.66.5", "www.example.com.", ""},
+		{"wildcard listener local answer denied", wildcard, "192.168.1.66", "host1.home.", ""},
+		{"wildcard listener recursion", wildcard, "192.168.1.66", "www.example.com.", "203.0.113.1"},
+		{"wildcard listener local answer", wildcard, "192.168.1.50", "host1.home.", "192.168.1.1"},
+		{"wildcard listener is TCP only", testLocalAddr, "192.168.1.66", "host1.home.", "192.168.1.1"},
+		{"listener recursion denied", noRecursion, "192.168.1.50", "www.example.com.", ""},
+		{"listener local answer", noRecursion, "192.168.1.50", "host1.home.", "192.168.1.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			resp := testQueryOn(t, s, test.localAddr, test.client, test.qname, dns.TypeA)
+
+			rcode := dns.RcodeSuccess
+			if test.answer == "" {
+				rcode = dns.RcodeRefused
+			}
+
+			if resp.Rcode != rcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[rcode], dns.RcodeToString[resp.Rcode])
+			}
+
+			if v := testAnswerValue(resp); v != test.answer {
+				t.Fatalf("expected answer %q, got %q", test.answer, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,488 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	logger "github.com/jodydadescott/jody-go-logger"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/jodydadescott/home-dns-server/types"
+	"github.com/jodydadescott/home-dns-server/types/action"
+	"github.com/jodydadescott/home-dns-server/types/listformat"
+)
+
+// blocklist answers queries for ad and tracker names instead of forwarding them.
+// The lists are reloaded on the same ticker pattern as the provider clients.
+type blocklist struct {
+	mutex           sync.RWMutex
+	ticker          *xticker
+	done            chan bool
+	sources         []*BlocklistSource
+	allowlist       map[string]bool
+	action          action.Action
+	sinkholeIPv4    net.IP
+	sinkholeIPv6    net.IP
+	ttl             uint32
+	refreshDuration time.Duration
+	httpClient      *http.Client
+
+	// lists holds the entries of each list by name so a list that fails to
+	// load keeps the entries from the last successful load
+	lists map[string]*blocklistEntries
+
+	// names are blocked exactly, domains are blocked with their subdomains and
+	// exceptions are allowed with their subdomains
+	names      map[string]bool
+	domains    map[string]bool
+	exceptions map[string]bool
+}
+
+type blocklistEntries struct {
+	names      []string
+	domains    []string
+	exceptions []string
+}
+
+func newBlocklist(config *BlocklistConfig) *blocklist {
+
+	if config == nil {
+		panic("config is required")
+	}
+
+	config = config.Clone()
+
+	switch config.Action {
+
+	case action.NXDomain, action.Zero:
+
+	case action.Sinkhole:
+		if config.SinkholeIPv4 == "" && config.SinkholeIPv6 == "" {
+			panic("SinkholeIPv4 or SinkholeIPv6 is required for sinkhole action")
+		}
+
+	case action.Empty:
+		config.Action = types.DefaultBlocklistAction
+
+	default:
+		panic("Action Invalid")
+	}
+
+	if config.TTL <= 0 {
+		config.TTL = types.DefaultBlocklistTTL
+	}
+
+	if config.Refresh <= 0 {
+		config.Refresh = types.DefaultBlocklistRefresh
+	}
+
+	b := &blocklist{
+		allowlist:       make(map[string]bool),
+		action:          config.Action,
+		ttl:             uint32(config.TTL.Seconds()),
+		refreshDuration: config.Refresh,
+		httpClient:      &http.Client{Timeout: types.DefaultBlocklistTimeout},
+		lists:           make(map[string]*blocklistEntries),
+	}
+
+	if config.SinkholeIPv4 != "" {
+		b.sinkholeIPv4 = net.ParseIP(config.SinkholeIPv4).To4()
+		if b.sinkholeIPv4 == nil {
+			panic(fmt.Sprintf("SinkholeIPv4 %s is invalid", config.SinkholeIPv4))
+		}
+	}
+
+	if config.SinkholeIPv6 != "" {
+		b.sinkholeIPv6 = net.ParseIP(config.SinkholeIPv6)
+		if b.sinkholeIPv6 == nil || b.sinkholeIPv6.To4() != nil {
+			panic(fmt.Sprintf("SinkholeIPv6 %s is invalid", config.SinkholeIPv6))
+		}
+	}
+
+	for _, name := range config.Allowlist {
+		b.allowlist[dns.Fqdn(strings.ToLower(name))] = true
+	}
+
+	names := make(map[string]bool)
+
+	for _, source := range config.Lists {
+
+		if source == nil {
+			panic("nil blocklist")
+		}
+
+		if !source.Enabled {
+			zap.L().Debug(fmt.Sprintf("Blocklist %s is not enabled", source.GetName()))
+			continue
+		}
+
+		if (source.Path == "") == (source.URL == "") {
+			panic(fmt.Sprintf("blocklist %s requires either a path or a URL", source.GetName()))
+		}
+
+		switch source.Format {
+
+		case listformat.Hosts, listformat.Domains, listformat.AdBlock:
+
+		case listformat.Empty:
+			source.Format = types.DefaultBlocklistFormat
+
+		default:
+			panic("Format Invalid")
+		}
+
+		if names[source.GetName()] {
+			panic(fmt.Sprintf("blocklist %s is defined more than once", source.GetName()))
+		}
+		names[source.GetName()] = true
+
+		b.sources = append(b.sources, source)
+	}
+
+	return b
+}
+
+func (t *blocklist) run() {
+
+	tick := func() {
+		zap.L().Debug("Running refresh for blocklists")
+		err := t.refresh()
+
+		if err == nil {
+			t.ticker.reset(t.refreshDuration)
+			return
+		}
+
+		zap.L().Error(fmt.Sprintf("Error on blocklists, setting retry interval to low; error is %s", err.Error()))
+		t.ticker.reset(errRefreshDuration)
+	}
+
+	zap.L().Info(fmt.Sprintf("Refresh for blocklists is %s", t.refreshDuration.String()))
+
+	t.done = make(chan bool)
+	t.ticker = &xticker{}
+	t.ticker.reset(t.refreshDuration)
+
+	done := t.done
+
+	// The lists may be downloaded through this server so the first load does
+	// not hold up the listeners. Nothing is blocked until it completes.
+	go func() {
+		tick()
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-t.ticker.ticker.C:
+				tick()
+
+			}
+		}
+	}()
+}
+
+func (t *blocklist) shutdown() {
+
+	zap.L().Info("Shutting down blocklists")
+
+	if t.ticker != nil {
+		t.ticker.stop()
+	}
+
+	// The channel is closed rather than sent on so shutdown does not wait for
+	// a download in progress
+	if t.done != nil {
+		close(t.done)
+	}
+}
+
+// refresh loads every list and replaces the blocked names. The names of a list
+// that fails to load are kept from the previous refresh.
+func (t *blocklist) refresh() error {
+
+	var errs *multierror.Error
+
+	for _, source := range t.sources {
+
+		entries, err := t.load(source)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("blocklist %s failed; error %w", source.GetName(), err))
+			continue
+		}
+
+		zap.L().Debug(fmt.Sprintf("Loaded %d names from blocklist %s", len(entries.names)+len(entries.domains), source.GetName()))
+		t.lists[source.GetName()] = entries
+	}
+
+	names := make(map[string]bool)
+	domains := make(map[string]bool)
+	exceptions := make(map[string]bool)
+
+	for _, entries := range t.lists {
+		for _, name := range entries.names {
+			names[name] = true
+		}
+		for _, name := range entries.domains {
+			domains[name] = true
+		}
+		for _, name := range entries.exceptions {
+			exceptions[name] = true
+		}
+	}
+
+	t.mutex.Lock()
+	t.names = names
+	t.domains = domains
+	t.exceptions = exceptions
+	t.mutex.Unlock()
+
+	zap.L().Info(fmt.Sprintf("Blocklists have %d names", len(names)+len(domains)))
+
+	return errs.ErrorOrNil()
+}
+
+// load reads the list from the file or URL
+func (t *blocklist) load(source *BlocklistSource) (*blocklistEntries, error) {
+
+	if source.Path != "" {
+		f, err := os.Open(source.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseBlocklist(f, source.Format)
+	}
+
+	resp, err := t.httpClient.Get(source.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return parseBlocklist(resp.Body, source.Format)
+}
+
+// parseBlocklist returns the entries of the list. Comments, rules that are not
+// for a whole name and invalid names are skipped.
+func parseBlocklist(r io.Reader, format listformat.Format) (*blocklistEntries, error) {
+
+	entries := &blocklistEntries{}
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+
+		switch format {
+
+		case listformat.Hosts:
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			for _, name := range fields[1:] {
+				if name, ok := blocklistName(name); ok && !hostsReserved[name] {
+					entries.names = append(entries.names, name)
+				}
+			}
+
+		case listformat.Domains:
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 1 {
+				continue
+			}
+			if name, ok := blocklistName(fields[0]); ok {
+				entries.names = append(entries.names, name)
+			}
+
+		case listformat.AdBlock:
+			exception := strings.HasPrefix(line, "@@")
+			line = strings.TrimPrefix(line, "@@")
+
+			// Only ||name^ rules block a whole name, rules with modifiers other
+			// than important apply to some requests only
+			if !strings.HasPrefix(line, "||") {
+				continue
+			}
+			line, modifiers, _ := strings.Cut(line[2:], "$")
+			if modifiers != "" && modifiers != "important" {
+				continue
+			}
+			line, ok := strings.CutSuffix(line, "^")
+			if !ok || strings.ContainsAny(line, "/*") {
+				continue
+			}
+			if name, ok := blocklistName(line); ok {
+				if exception {
+					entries.exceptions = append(entries.exceptions, name)
+				} else {
+					entries.domains = append(entries.domains, name)
+				}
+			}
+
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// hostsReserved are the names in hosts files that map to the local host
+var hostsReserved = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// blocklistName returns the name fully qualified and in lower case and false if
+// it is not a valid name
+func blocklistName(name string) (string, bool) {
+
+	name = dns.Fqdn(strings.ToLower(name))
+
+	if name == "." {
+		return "", false
+	}
+
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", false
+	}
+
+	return name, true
+}
+
+// blocked returns true if the name is on a list and not allowed
+func (t *blocklist) blocked(name string) bool {
+
+	name = strings.ToLower(name)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	blocked := t.names[name]
+
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		parent := name[i:]
+		if t.allowlist[parent] || t.exceptions[parent] {
+			return false
+		}
+		if t.domains[parent] {
+			blocked = true
+		}
+	}
+
+	return blocked
+}
+
+// reply returns the answer for a blocked name
+func (t *blocklist) reply(r *dns.Msg) *dns.Msg {
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	q := r.Question[0]
+
+	if t.action == action.NXDomain {
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+
+	ipv4 := net.IPv4zero
+	ipv6 := net.IPv6zero
+
+	if t.action == action.Sinkhole {
+		ipv4 = t.sinkholeIPv4
+		ipv6 = t.sinkholeIPv6
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: t.ttl}
+
+	switch q.Qtype {
+
+	case dns.TypeA:
+		if ipv4 != nil {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ipv4})
+		}
+
+	case dns.TypeAAAA:
+		if ipv6 != nil {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ipv6})
+		}
+
+	}
+
+	return m
+}
+
+// block writes the answer for a blocked name and returns true if the name of
+// the request is blocked for the client group
+func (t *Server) block(g *clientGroup, w dns.ResponseWriter, r *dns.Msg) bool {
+
+	b := t.getBlocklist(g)
+
+	if b == nil || !b.blocked(r.Question[0].Name) {
+		return false
+	}
+
+	if logger.Trace {
+		zap.L().Debug(fmt.Sprintf("%s is blocked", r.Question[0].Name))
+	}
+
+	w.WriteMsg(b.reply(r))
+	return true
+}
+
+// blockedCNAME returns true if a CNAME in the response points to a blocked name
+// so that trackers cannot be hidden behind a CNAME in an allowed domain
+func (t *Server) blockedCNAME(g *clientGroup, resp *dns.Msg) bool {
+
+	b := t.getBlocklist(g)
+
+	if b == nil {
+		return false
+	}
+
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && b.blocked(cname.Target) {
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("%s is blocked by CNAME %s", cname.Hdr.Name, cname.Target))
+			}
+			return true
+		}
+	}
+
+	return false
+}
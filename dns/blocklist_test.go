@@ -0,0 +1,319 @@
+package dns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jodydadescott/home-dns-server/types"
+	"github.com/jodydadescott/home-dns-server/types/action"
+	"github.com/jodydadescott/home-dns-server/types/listformat"
+)
+
+// testFile writes the lines to a file in a temporary directory and returns its path
+func testFile(t *testing.T, name string, lines ...string) string {
+
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// testLastAnswerValue returns the value of the last answer which is the
+// address at the end of a CNAME chain
+func testLastAnswerValue(m *dns.Msg) string {
+
+	if len(m.Answer) <= 0 {
+		return ""
+	}
+
+	return testAnswerValue(&dns.Msg{Answer: m.Answer[len(m.Answer)-1:]})
+}
+
+func TestParseBlocklist(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		format     listformat.Format
+		lines      []string
+		names      []string
+		domains    []string
+		exceptions []string
+	}{
+		{
+			name:   "hosts",
+			format: listformat.Hosts,
+			lines: []string{
+				"# comment",
+				"0.0.0.0 ads.example.com tracker.example.com # trailing comment",
+				"127.0.0.1 localhost",
+				"::1 ip6-localhost",
+				"0.0.0.0 0.0.0.0",
+				"Ads.Example.NET",
+				"not-an-ip bad.example.com",
+				"",
+			},
+			names: []string{"ads.example.com.", "tracker.example.com."},
+		},
+		{
+			name:   "domains",
+			format: listformat.Domains,
+			lines: []string{
+				"# comment",
+				"Ads.Example.com",
+				"tracker.example.com # trailing comment",
+				"two names.example.com",
+				"bad..example.com",
+			},
+			names: []string{"ads.example.com.", "tracker.example.com."},
+		},
+		{
+			name:   "adblock",
+			format: listformat.AdBlock,
+			lines: []string{
+				"! comment",
+				"[Adblock Plus 2.0]",
+				"||ads.example.com^",
+				"||important.example.com^$important",
+				"||third-party.example.com^$third-party",
+				"||path.example.com/ads^",
+				"||nocaret.example.com",
+				"@@||ok.ads.example.com^",
+				"example.com##.banner",
+				"/ads/*",
+			},
+			domains:    []string{"ads.example.com.", "important.example.com."},
+			exceptions: []string{"ok.ads.example.com."},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			entries, err := parseBlocklist(strings.NewReader(strings.Join(test.lines, "\n")), test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(entries.names, test.names) {
+				t.Fatalf("expected names %v, got %v", test.names, entries.names)
+			}
+
+			if !reflect.DeepEqual(entries.domains, test.domains) {
+				t.Fatalf("expected domains %v, got %v", test.domains, entries.domains)
+			}
+
+			if !reflect.DeepEqual(entries.exceptions, test.exceptions) {
+				t.Fatalf("expected exceptions %v, got %v", test.exceptions, entries.exceptions)
+			}
+		})
+	}
+}
+
+func TestBlocklistReply(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config *BlocklistConfig
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"nxdomain", &BlocklistConfig{Action: action.NXDomain}, dns.TypeA, dns.RcodeNameError, ""},
+		{"zero A", &BlocklistConfig{Action: action.Zero}, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{"zero AAAA", &BlocklistConfig{Action: action.Zero}, dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{"zero other type", &BlocklistConfig{Action: action.Zero}, dns.TypeMX, dns.RcodeSuccess, ""},
+		{"default is zero", &BlocklistConfig{}, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{"sinkhole A", &BlocklistConfig{Action: action.Sinkhole, SinkholeIPv4: "192.0.2.53", SinkholeIPv6: "2001:db8::53"}, dns.TypeA, dns.RcodeSuccess, "192.0.2.53"},
+		{"sinkhole AAAA", &BlocklistConfig{Action: action.Sinkhole, SinkholeIPv4: "192.0.2.53", SinkholeIPv6: "2001:db8::53"}, dns.TypeAAAA, dns.RcodeSuccess, "2001:db8::53"},
+		{"sinkhole without IPv6", &BlocklistConfig{Action: action.Sinkhole, SinkholeIPv4: "192.0.2.53"}, dns.TypeAAAA, dns.RcodeSuccess, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := new(dns.Msg)
+			r.SetQuestion("ads.example.com.", test.qtype)
+
+			m := newBlocklist(test.config).reply(r)
+
+			if m.Rcode != test.rcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[test.rcode], dns.RcodeToString[m.Rcode])
+			}
+
+			if v := testAnswerValue(m); v != test.answer {
+				t.Fatalf("expected answer %q, got %q", test.answer, v)
+			}
+
+			if len(m.Answer) > 0 && m.Answer[0].Header().Ttl != uint32(types.DefaultBlocklistTTL.Seconds()) {
+				t.Fatalf("expected default TTL, got %d", m.Answer[0].Header().Ttl)
+			}
+		})
+	}
+}
+
+func TestBlocklistServer(t *testing.T) {
+
+	nameserver := testNameserver(t, func(w dns.ResponseWriter, r *dns.Msg) {
+
+		// A tracker hidden behind a CNAME in an allowed domain
+		if r.Question[0].Name == "cloaked.example.com." {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			cname, _ := dns.NewRR("cloaked.example.com. 60 CNAME tracker.example.net.")
+			a, _ := dns.NewRR("tracker.example.net. 60 A 203.0.113.9")
+			m.Answer = append(m.Answer, cname, a)
+			w.WriteMsg(m)
+			return
+		}
+
+		testAnswer("203.0.113.1")(w, r)
+	})
+
+	config := &Config{
+		Nameservers: []*NetPort{nameserver},
+		Blocklist: &BlocklistConfig{
+			Enabled:   true,
+			Allowlist: []string{"allowed.adnet.example.org"},
+		},
+	}
+
+	config.Blocklist.AddLists(
+		&BlocklistSource{Name: "hosts", Enabled: true, Format: listformat.Hosts, Path: testFile(t, "hosts", "0.0.0.0 ads.example.com")},
+		&BlocklistSource{Name: "domains", Enabled: true, Format: listformat.Domains, Path: testFile(t, "domains", "tracker.example.net")},
+		&BlocklistSource{Name: "adblock", Enabled: true, Format: listformat.AdBlock, Path: testFile(t, "adblock", "||adnet.example.org^", "@@||ok.adnet.example.org^")},
+	)
+
+	d := testDomain()
+	d.Records.AddCNameRecords(
+		&types.CNameRecord{AliasHostname: "ads", TargetHostname: "tracker", TargetDomain: "example.net"},
+		&types.CNameRecord{AliasHostname: "cdn", TargetHostname: "cloaked", TargetDomain: "example.com"},
+		&types.CNameRecord{AliasHostname: "fine", TargetHostname: "www", TargetDomain: "example.com"},
+	)
+
+	for _, provider := range testProviders(d) {
+		config.AddProvider(provider)
+	}
+
+	s := testServer(t, config)
+
+	tests := []struct {
+		name   string
+		qname  string
+		answer string
+	}{
+		{"hosts name", "ads.example.com.", "0.0.0.0"},
+		{"hosts names do not block subdomains", "sub.ads.example.com.", "203.0.113.1"},
+		{"domains name", "Tracker.Example.NET.", "0.0.0.0"},
+		{"adblock blocks subdomains", "x.adnet.example.org.", "0.0.0.0"},
+		{"adblock exception", "ok.adnet.example.org.", "203.0.113.1"},
+		{"adblock exception covers subdomains", "a.ok.adnet.example.org.", "203.0.113.1"},
+		{"allowlist", "allowed.adnet.example.org.", "203.0.113.1"},
+		{"not listed", "www.example.com.", "203.0.113.1"},
+		{"CNAME to blocked name", "cloaked.example.com.", "0.0.0.0"},
+		{"local CNAME to blocked name", "ads.home.", "0.0.0.0"},
+		{"local CNAME to a CNAME to blocked name", "cdn.home.", "0.0.0.0"},
+		{"local CNAME to allowed name", "fine.home.", "203.0.113.1"},
+		{"local names are not blocked", "host1.home.", "192.168.1.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			resp := testQuery(t, s, "192.168.1.50", test.qname, dns.TypeA)
+
+			if v := testLastAnswerValue(resp); v != test.answer {
+				t.Fatalf("expected answer %q, got %q", test.answer, v)
+			}
+
+			// A blocked answer is for the name that was asked
+			if test.answer == "0.0.0.0" && (len(resp.Answer) != 1 || !strings.EqualFold(resp.Answer[0].Header().Name, test.qname)) {
+				t.Fatalf("expected a single answer for %s, got %v", test.qname, resp.Answer)
+			}
+		})
+	}
+}
+
+func TestBlocklistBackgroundLoad(t *testing.T) {
+
+	release := make(chan struct{})
+
+	list := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+			w.Write([]byte("ads.example.com\n"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer list.Close()
+
+	config := &BlocklistConfig{Enabled: true}
+	config.AddLists(&BlocklistSource{Name: "slow", Enabled: true, Format: listformat.Domains, URL: list.URL})
+
+	b := newBlocklist(config)
+
+	start := time.Now()
+	b.run()
+
+	if time.Since(start) > time.Second {
+		t.Fatal("expected run to return before the list is loaded")
+	}
+
+	// Nothing is blocked until the list is loaded
+	if b.blocked("ads.example.com.") {
+		t.Fatal("unexpected block before load")
+	}
+
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.blocked("ads.example.com.") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected block after load")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.shutdown()
+}
+
+func TestBlocklistShutdownDuringLoad(t *testing.T) {
+
+	list := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer list.Close()
+
+	config := &BlocklistConfig{Enabled: true}
+	config.AddLists(&BlocklistSource{Name: "hang", Enabled: true, URL: list.URL})
+
+	b := newBlocklist(config)
+	b.run()
+
+	done := make(chan struct{})
+
+	go func() {
+		b.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected shutdown not to wait for the download")
+	}
+
+	list.CloseClientConnections()
+}
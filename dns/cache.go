@@ -0,0 +1,406 @@
+package dns
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jodydadescott/home-dns-server/types"
+)
+
+// cache is a LRU cache of forwarded responses. Positive answers are cached for
+// the lowest TTL of the records and negative answers for the SOA TTL or minimum
+// per RFC 2308, whichever is lower. With serve stale enabled expired entries are
+// kept for staleTTL so they can be returned when the nameservers fail.
+type cache struct {
+	mutex              sync.Mutex
+	maxEntries         int
+	minTTL             time.Duration
+	maxTTL             time.Duration
+	maxNegativeTTL     time.Duration
+	serveStale         bool
+	staleTTL           time.Duration
+	staleAnswerTTL     time.Duration
+	prefetch           bool
+	prefetchHits       int
+	prefetchPercentage int
+	entries            map[cacheKey]*list.Element
+	lru                *list.List
+	stats              CacheStats
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+}
+
+func newCache(config *CacheConfig) *cache {
+
+	if config == nil {
+		panic("config is required")
+	}
+
+	c := &cache{
+		maxEntries:     config.MaxEntries,
+		minTTL:         config.MinTTL,
+		maxTTL:         config.MaxTTL,
+		maxNegativeTTL: config.MaxNegativeTTL,
+		serveStale:     config.ServeStale,
+		staleTTL:       config.StaleTTL,
+		staleAnswerTTL: config.StaleAnswerTTL,
+		prefetch:       config.Prefetch,
+		prefetchHits:   config.PrefetchHits,
+		entries:        make(map[cacheKey]*list.Element),
+		lru:            list.New(),
+
+		prefetchPercentage: config.PrefetchPercentage,
+	}
+
+	if c.maxEntries <= 0 {
+		c.maxEntries = types.DefaultCacheMaxEntries
+	}
+
+	if c.maxTTL <= 0 {
+		c.maxTTL = types.DefaultCacheMaxTTL
+	}
+
+	if c.maxNegativeTTL <= 0 {
+		c.maxNegativeTTL = types.DefaultCacheMaxNegativeTTL
+	}
+
+	if c.staleTTL <= 0 {
+		c.staleTTL = types.DefaultCacheStaleTTL
+	}
+
+	if c.staleAnswerTTL <= 0 {
+		c.staleAnswerTTL = types.DefaultCacheStaleAnswerTTL
+	}
+
+	if c.prefetchHits <= 0 {
+		c.prefetchHits = types.DefaultPrefetchHits
+	}
+
+	if c.prefetchPercentage <= 0 || c.prefetchPercentage >= 100 {
+		c.prefetchPercentage = types.DefaultPrefetchPercentage
+	}
+
+	c.stats.MaxEntries = c.maxEntries
+
+	return c
+}
+
+func newCacheKey(r *dns.Msg) (cacheKey, bool) {
+
+	if len(r.Question) != 1 {
+		return cacheKey{}, false
+	}
+
+	q := r.Question[0]
+
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	return cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		do:     do,
+	}, true
+}
+
+// get returns a copy of the cached response for the request with the TTLs
+// decremented by the time spent in the cache or nil. If the entry is popular
+// and about to expire prefetch is true and the caller should refresh it.
+func (t *cache) get(r *dns.Msg) (resp *dns.Msg, prefetch bool) {
+
+	key, ok := newCacheKey(r)
+	if !ok {
+		return nil, false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	element := t.entries[key]
+	if element == nil {
+		t.stats.Misses++
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+
+	now := time.Now()
+
+	if !now.Before(entry.expires) {
+		// Expired entries are kept for serve stale until the stale period ends
+		if !t.serveStale || !now.Before(entry.expires.Add(t.staleTTL)) {
+			t.remove(element)
+			t.stats.Expired++
+		}
+		t.stats.Misses++
+		return nil, false
+	}
+
+	t.lru.MoveToFront(element)
+	t.stats.Hits++
+	entry.hits++
+
+	if t.prefetch && !entry.prefetching && entry.hits >= t.prefetchHits {
+		lifetime := entry.expires.Sub(entry.stored)
+		if entry.expires.Sub(now) <= lifetime*time.Duration(t.prefetchPercentage)/100 {
+			entry.prefetching = true
+			prefetch = true
+			t.stats.Prefetches++
+		}
+	}
+
+	return entry.reply(r, now), prefetch
+}
+
+// getStale returns a copy of an expired response for the request with the
+// stale answer TTL or nil if there is none within the stale period
+func (t *cache) getStale(r *dns.Msg) *dns.Msg {
+
+	if !t.serveStale {
+		return nil
+	}
+
+	key, ok := newCacheKey(r)
+	if !ok {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	element := t.entries[key]
+	if element == nil {
+		return nil
+	}
+
+	entry := element.Value.(*cacheEntry)
+
+	now := time.Now()
+
+	if !now.Before(entry.expires.Add(t.staleTTL)) {
+		t.remove(element)
+		t.stats.Expired++
+		return nil
+	}
+
+	t.lru.MoveToFront(element)
+	t.stats.Stale++
+
+	m := entry.reply(r, now)
+	setTTL(m, uint32(t.staleAnswerTTL.Seconds()))
+	return m
+}
+
+// prefetchFailed allows a later hit to try the prefetch again
+func (t *cache) prefetchFailed(r *dns.Msg) {
+
+	key, ok := newCacheKey(r)
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if element := t.entries[key]; element != nil {
+		element.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// reply returns a copy of the cached message as a reply to the request
+func (t *cacheEntry) reply(r *dns.Msg, now time.Time) *dns.Msg {
+
+	m := t.msg.Copy()
+	m.Id = r.Id
+	m.Question = r.Question
+
+	elapsed := uint32(now.Sub(t.stored).Seconds())
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+
+	return m
+}
+
+// setTTL sets the TTL of every record in the message ignoring OPT
+func setTTL(m *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
+
+// set adds the response for the request to the cache if it is cacheable
+func (t *cache) set(r, resp *dns.Msg) {
+
+	if resp == nil || resp.Truncated {
+		return
+	}
+
+	key, ok := newCacheKey(r)
+	if !ok {
+		return
+	}
+
+	ttl, ok := t.getTTL(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	entry := &cacheEntry{
+		key:     key,
+		msg:     resp.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	// Records are not served with a TTL beyond the life of the entry. For
+	// negative answers this sets the SOA TTL to the negative TTL per RFC 2308.
+	maxTTL := uint32(ttl.Seconds())
+	for _, section := range [][]dns.RR{entry.msg.Answer, entry.msg.Ns, entry.msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > maxTTL {
+				rr.Header().Ttl = maxTTL
+			}
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if element := t.entries[key]; element != nil {
+		// A refreshed entry keeps its popularity so that it continues to be prefetched
+		entry.hits = element.Value.(*cacheEntry).hits
+		element.Value = entry
+		t.lru.MoveToFront(element)
+		return
+	}
+
+	t.entries[key] = t.lru.PushFront(entry)
+	t.stats.Insertions++
+
+	for t.lru.Len() > t.maxEntries {
+		t.remove(t.lru.Back())
+		t.stats.Evictions++
+	}
+}
+
+// getTTL returns how long the response may be cached and false if it may not
+func (t *cache) getTTL(resp *dns.Msg) (time.Duration, bool) {
+
+	switch resp.Rcode {
+
+	case dns.RcodeSuccess:
+		if len(resp.Answer) > 0 {
+			ttl := minTTL(resp.Answer)
+			if ttl < t.minTTL {
+				ttl = t.minTTL
+			}
+			if ttl > t.maxTTL {
+				ttl = t.maxTTL
+			}
+			return ttl, true
+		}
+		// NODATA
+		return t.getNegativeTTL(resp)
+
+	case dns.RcodeNameError:
+		return t.getNegativeTTL(resp)
+
+	}
+
+	return 0, false
+}
+
+// getNegativeTTL returns the negative caching TTL from the SOA in the authority
+// section. Per RFC 2308 negative answers without a SOA are not cached.
+func (t *cache) getNegativeTTL(resp *dns.Msg) (time.Duration, bool) {
+
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			negativeTTL := time.Duration(ttl) * time.Second
+			if negativeTTL > t.maxNegativeTTL {
+				negativeTTL = t.maxNegativeTTL
+			}
+			return negativeTTL, true
+		}
+	}
+
+	return 0, false
+}
+
+// remove removes the element, the caller must hold the lock
+func (t *cache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	delete(t.entries, entry.key)
+	t.lru.Remove(element)
+}
+
+func (t *cache) getStats() *CacheStats {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := t.stats
+	stats.Entries = t.lru.Len()
+	return &stats
+}
+
+// minTTL returns the lowest TTL of the records ignoring OPT
+func minTTL(rrs []dns.RR) time.Duration {
+
+	var ttl uint32
+	found := false
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+
+	return time.Duration(ttl) * time.Second
+}
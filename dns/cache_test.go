@@ -0,0 +1,367 @@
+package dns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testCacheRequest(name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	return r
+}
+
+// testCacheResponse returns a reply to the request with the records
+func testCacheResponse(r *dns.Msg, rcode int, answer []string, ns []string) *dns.Msg {
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+
+	for _, v := range answer {
+		rr, _ := dns.NewRR(v)
+		m.Answer = append(m.Answer, rr)
+	}
+
+	for _, v := range ns {
+		rr, _ := dns.NewRR(v)
+		m.Ns = append(m.Ns, rr)
+	}
+
+	return m
+}
+
+// testCacheAge moves the entry for the request back in time as if it had been
+// stored the duration ago
+func testCacheAge(c *cache, r *dns.Msg, d time.Duration) {
+
+	key, _ := newCacheKey(r)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.entries[key].Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-d)
+	entry.expires = entry.expires.Add(-d)
+}
+
+func TestCacheTTL(t *testing.T) {
+
+	const soa = "example.com. 600 SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 300"
+
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []string
+		ns     []string
+		ttl    time.Duration
+		cached bool
+	}{
+		{"positive uses the lowest TTL", dns.RcodeSuccess, []string{"a.example.com. 120 A 192.0.2.1", "a.example.com. 60 A 192.0.2.2"}, nil, 60 * time.Second, true},
+		{"positive is raised to the min TTL", dns.RcodeSuccess, []string{"a.example.com. 1 A 192.0.2.1"}, nil, 10 * time.Second, true},
+		{"positive is lowered to the max TTL", dns.RcodeSuccess, []string{"a.example.com. 86400 A 192.0.2.1"}, nil, time.Hour, true},
+		{"NXDOMAIN uses the SOA minimum", dns.RcodeNameError, nil, []string{soa}, 300 * time.Second, true},
+		{"NXDOMAIN uses the SOA TTL when lower", dns.RcodeNameError, nil, []string{"example.com. 30 SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 300"}, 30 * time.Second, true},
+		{"NXDOMAIN is lowered to the max negative TTL", dns.RcodeNameError, nil, []string{"example.com. 7200 SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 7200"}, 15 * time.Minute, true},
+		{"NODATA uses the SOA minimum", dns.RcodeSuccess, nil, []string{soa}, 300 * time.Second, true},
+		{"NXDOMAIN without a SOA is not cached", dns.RcodeNameError, nil, nil, 0, false},
+		{"NODATA without a SOA is not cached", dns.RcodeSuccess, nil, nil, 0, false},
+		{"SERVFAIL is not cached", dns.RcodeServerFailure, nil, nil, 0, false},
+		{"REFUSED is not cached", dns.RcodeRefused, nil, nil, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			c := newCache(&CacheConfig{
+				MinTTL:         10 * time.Second,
+				MaxTTL:         time.Hour,
+				MaxNegativeTTL: 15 * time.Minute,
+			})
+
+			r := testCacheRequest("a.example.com.", dns.TypeA)
+			c.set(r, testCacheResponse(r, test.rcode, test.answer, test.ns))
+
+			key, _ := newCacheKey(r)
+			element := c.entries[key]
+
+			if (element != nil) != test.cached {
+				t.Fatalf("expected cached %v", test.cached)
+			}
+
+			if element == nil {
+				return
+			}
+
+			entry := element.Value.(*cacheEntry)
+
+			if ttl := entry.expires.Sub(entry.stored); ttl != test.ttl {
+				t.Fatalf("expected TTL %s, got %s", test.ttl, ttl)
+			}
+
+			// No record is served with a TTL beyond the life of the entry
+			for _, section := range [][]dns.RR{entry.msg.Answer, entry.msg.Ns} {
+				for _, rr := range section {
+					if time.Duration(rr.Header().Ttl)*time.Second > test.ttl {
+						t.Fatalf("record %s outlives the entry", rr.String())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+
+	c := newCache(&CacheConfig{})
+
+	r := testCacheRequest("a.example.com.", dns.TypeA)
+	c.set(r, testCacheResponse(r, dns.RcodeSuccess, []string{"a.example.com. 300 A 192.0.2.1"}, nil))
+
+	// Names are matched regardless of case and the question of the request is kept
+	upper := testCacheRequest("A.Example.COM.", dns.TypeA)
+
+	resp, _ := c.get(upper)
+	if resp == nil {
+		t.Fatal("expected hit")
+	}
+
+	if resp.Id != upper.Id || resp.Question[0].Name != "A.Example.COM." {
+		t.Fatal("expected reply to the request")
+	}
+
+	// The TTL is decremented by the time spent in the cache
+	testCacheAge(c, r, 100*time.Second)
+
+	resp, _ = c.get(r)
+	if resp == nil || resp.Answer[0].Header().Ttl != 200 {
+		t.Fatalf("expected TTL 200, got %v", resp)
+	}
+
+	// The type, class and DO bit are part of the key
+	if resp, _ := c.get(testCacheRequest("a.example.com.", dns.TypeAAAA)); resp != nil {
+		t.Fatal("expected miss for other type")
+	}
+
+	do := testCacheRequest("a.example.com.", dns.TypeA)
+	do.SetEdns0(1232, true)
+
+	if resp, _ := c.get(do); resp != nil {
+		t.Fatal("expected miss for DO bit")
+	}
+
+	// Expired entries are removed
+	testCacheAge(c, r, 300*time.Second)
+
+	if resp, _ := c.get(r); resp != nil {
+		t.Fatal("expected miss after expiry")
+	}
+
+	stats := c.getStats()
+	if stats.Hits != 2 || stats.Misses != 3 || stats.Expired != 1 || stats.Entries != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+
+	c := newCache(&CacheConfig{MaxEntries: 2})
+
+	a := testCacheRequest("a.example.com.", dns.TypeA)
+	b := testCacheRequest("b.example.com.", dns.TypeA)
+	d := testCacheRequest("d.example.com.", dns.TypeA)
+
+	c.set(a, testCacheResponse(a, dns.RcodeSuccess, []string{"a.example.com. 300 A 192.0.2.1"}, nil))
+	c.set(b, testCacheResponse(b, dns.RcodeSuccess, []string{"b.example.com. 300 A 192.0.2.2"}, nil))
+
+	// a is used so b is the least recently used when d is added
+	c.get(a)
+	c.set(d, testCacheResponse(d, dns.RcodeSuccess, []string{"d.example.com. 300 A 192.0.2.4"}, nil))
+
+	if resp, _ := c.get(b); resp != nil {
+		t.Fatal("expected b to be evicted")
+	}
+
+	for _, r := range []*dns.Msg{a, d} {
+		if resp, _ := c.get(r); resp == nil {
+			t.Fatalf("expected %s to be cached", r.Question[0].Name)
+		}
+	}
+
+	if stats := c.getStats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		serveStale bool
+		age        time.Duration
+		stale      bool
+	}{
+		{"disabled", false, 90 * time.Second, false},
+		{"within the stale period", true, 90 * time.Second, true},
+		{"after the stale period", true, 61*time.Second + time.Hour, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			c := newCache(&CacheConfig{
+				ServeStale:     test.serveStale,
+				StaleTTL:       time.Hour,
+				StaleAnswerTTL: 30 * time.Second,
+			})
+
+			r := testCacheRequest("a.example.com.", dns.TypeA)
+			c.set(r, testCacheResponse(r, dns.RcodeSuccess, []string{"a.example.com. 60 A 192.0.2.1"}, nil))
+
+			testCacheAge(c, r, test.age)
+
+			// An expired entry is never a hit even if it may be served stale
+			if resp, _ := c.get(r); resp != nil {
+				t.Fatal("expected miss")
+			}
+
+			resp := c.getStale(r)
+
+			if (resp != nil) != test.stale {
+				t.Fatalf("expected stale %v", test.stale)
+			}
+
+			if resp != nil && resp.Answer[0].Header().Ttl != 30 {
+				t.Fatalf("expected stale answer TTL 30, got %d", resp.Answer[0].Header().Ttl)
+			}
+		})
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+
+	c := newCache(&CacheConfig{
+		Prefetch:           true,
+		PrefetchHits:       2,
+		PrefetchPercentage: 10,
+	})
+
+	r := testCacheRequest("a.example.com.", dns.TypeA)
+	c.set(r, testCacheResponse(r, dns.RcodeSuccess, []string{"a.example.com. 100 A 192.0.2.1"}, nil))
+
+	// Not popular enough
+	if _, prefetch := c.get(r); prefetch {
+		t.Fatal("unexpected prefetch on first hit")
+	}
+
+	// Popular but not about to expire
+	if _, prefetch := c.get(r); prefetch {
+		t.Fatal("unexpected prefetch before the last 10 percent")
+	}
+
+	testCacheAge(c, r, 95*time.Second)
+
+	if _, prefetch := c.get(r); !prefetch {
+		t.Fatal("expected prefetch in the last 10 percent")
+	}
+
+	// Only one prefetch is in flight at a time
+	if _, prefetch := c.get(r); prefetch {
+		t.Fatal("unexpected second prefetch")
+	}
+
+	c.prefetchFailed(r)
+
+	if _, prefetch := c.get(r); !prefetch {
+		t.Fatal("expected prefetch after a failed prefetch")
+	}
+
+	// A refreshed entry keeps its popularity
+	c.set(r, testCacheResponse(r, dns.RcodeSuccess, []string{"a.example.com. 100 A 192.0.2.1"}, nil))
+	testCacheAge(c, r, 95*time.Second)
+
+	if _, prefetch := c.get(r); !prefetch {
+		t.Fatal("expected prefetch of refreshed entry")
+	}
+}
+
+func TestServerServeStale(t *testing.T) {
+
+	var failing atomic.Bool
+
+	nameserver := testNameserver(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if failing.Load() {
+			testRcode(dns.RcodeServerFailure)(w, r)
+			return
+		}
+		testAnswer("203.0.113.1")(w, r)
+	})
+
+	s := testServer(t, &Config{
+		Nameservers: []*NetPort{nameserver},
+		Cache: &CacheConfig{
+			Enabled:        true,
+			ServeStale:     true,
+			StaleAnswerTTL: 30 * time.Second,
+		},
+	})
+
+	if v := testAnswerValue(testQuery(t, s, "192.168.1.50", "example.com.", dns.TypeA)); v != "203.0.113.1" {
+		t.Fatalf("expected answer from nameserver, got %q", v)
+	}
+
+	testCacheAge(s.cache, testCacheRequest("example.com.", dns.TypeA), 61*time.Second)
+	failing.Store(true)
+
+	resp := testQuery(t, s, "192.168.1.50", "example.com.", dns.TypeA)
+
+	if v := testAnswerValue(resp); v != "203.0.113.1" {
+		t.Fatalf("expected stale answer, got %q", v)
+	}
+
+	if resp.Answer[0].Header().Ttl != 30 {
+		t.Fatalf("expected stale answer TTL 30, got %d", resp.Answer[0].Header().Ttl)
+	}
+}
+
+func TestServerPrefetch(t *testing.T) {
+
+	var ip atomic.Value
+	ip.Store("203.0.113.1")
+
+	nameserver := testNameserver(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		testAnswer(ip.Load().(string))(w, r)
+	})
+
+	s := testServer(t, &Config{
+		Nameservers: []*NetPort{nameserver},
+		Cache: &CacheConfig{
+			Enabled:      true,
+			Prefetch:     true,
+			PrefetchHits: 1,
+		},
+	})
+
+	testQuery(t, s, "192.168.1.50", "example.com.", dns.TypeA)
+
+	testCacheAge(s.cache, testCacheRequest("example.com.", dns.TypeA), 55*time.Second)
+	ip.Store("203.0.113.2")
+
+	// The hit is answered from the cache and refreshes the entry in the background
+	if v := testAnswerValue(testQuery(t, s, "192.168.1.50", "example.com.", dns.TypeA)); v != "203.0.113.1" {
+		t.Fatalf("expected cached answer, got %q", v)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if v := testAnswerValue(testQuery(t, s, "192.168.1.50", "example.com.", dns.TypeA)); v == "203.0.113.2" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("expected prefetched answer")
+}
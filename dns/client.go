@@ -1,11 +1,17 @@
 package dns
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	logger "github.com/jodydadescott/jody-go-logger"
+	"github.com/miekg/dns"
 
 	"go.uber.org/zap"
 )
@@ -19,10 +25,21 @@ type Client struct {
 	ticker *xticker
 	Provider
 	done         chan bool
-	aRecords     map[string]*ARecord
-	aaaaRecords  map[string]*ARecord
+	aRecords     map[string][]*ARecord
+	aaaaRecords  map[string][]*ARecord
 	ptrRecords   map[string]*PTRrecord
 	cnameRecords map[string]*CNameRecord
+	mxRecords    map[string][]*MXRecord
+	txtRecords   map[string][]*TXTRecord
+	srvRecords   map[string][]*SRVRecord
+	nsRecords    map[string][]*NSRecord
+	names        map[string]bool
+	macs         map[string]string
+	digest       string
+	generation   uint32
+
+	// onRefresh is called after each successful refresh
+	onRefresh func()
 }
 
 func newClient(provider Provider) *Client {
@@ -122,35 +139,35 @@ func (t *Client) shutdown() {
 
 }
 
-func (t *Client) getARecords() []*ARecord {
+func (t *Client) getAllARecords() []*ARecord {
 
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
 
 	var records []*ARecord
 
-	for _, record := range t.aRecords {
-		records = append(records, record)
+	for _, recordSet := range t.aRecords {
+		records = append(records, recordSet...)
 	}
 
 	return records
 }
 
-func (t *Client) getAAAARecords() []*ARecord {
+func (t *Client) getAllAAAARecords() []*ARecord {
 
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
 
 	var records []*ARecord
 
-	for _, record := range t.aaaaRecords {
-		records = append(records, record)
+	for _, recordSet := range t.aaaaRecords {
+		records = append(records, recordSet...)
 	}
 
 	return records
 }
 
-func (t *Client) getARecord(name string) *ARecord {
+func (t *Client) getARecords(name string) []*ARecord {
 
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
@@ -162,7 +179,7 @@ func (t *Client) getARecord(name string) *ARecord {
 	return t.aRecords[name]
 }
 
-func (t *Client) getAAAARecord(name string) *ARecord {
+func (t *Client) getAAAARecords(name string) []*ARecord {
 
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
@@ -198,60 +215,216 @@ func (t *Client) getCNameRecord(name string) *CNameRecord {
 	return t.cnameRecords[name]
 }
 
+func (t *Client) getMXRecords(name string) []*MXRecord {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.mxRecords == nil {
+		return nil
+	}
+
+	return t.mxRecords[name]
+}
+
+func (t *Client) getTXTRecords(name string) []*TXTRecord {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.txtRecords == nil {
+		return nil
+	}
+
+	return t.txtRecords[name]
+}
+
+func (t *Client) getSRVRecords(name string) []*SRVRecord {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.srvRecords == nil {
+		return nil
+	}
+
+	return t.srvRecords[name]
+}
+
+func (t *Client) getNSRecords(name string) []*NSRecord {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.nsRecords == nil {
+		return nil
+	}
+
+	return t.nsRecords[name]
+}
+
+// getPTRKeys returns the ARPA names of all PTR records
+func (t *Client) getPTRKeys() []string {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var keys []string
+
+	for key := range t.ptrRecords {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// hasName returns true if the name exists in any record type
+func (t *Client) hasName(name string) bool {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.names == nil {
+		return false
+	}
+
+	return t.names[name]
+}
+
+// getMAC returns the MAC of the host with the IP or an empty string
+func (t *Client) getMAC(ip string) string {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.macs == nil {
+		return ""
+	}
+
+	return t.macs[ip]
+}
+
+// getGeneration returns the number of times a refresh has changed the records
+func (t *Client) getGeneration() uint32 {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.generation
+}
+
 func (t *Client) refresh() error {
 
-	aRecords := make(map[string]*ARecord)
-	aaaRecords := make(map[string]*ARecord)
+	aRecords := make(map[string][]*ARecord)
+	aaaRecords := make(map[string][]*ARecord)
 	ptrRecords := make(map[string]*PTRrecord)
 	cnameRecords := make(map[string]*CNameRecord)
+	mxRecords := make(map[string][]*MXRecord)
+	txtRecords := make(map[string][]*TXTRecord)
+	srvRecords := make(map[string][]*SRVRecord)
+	nsRecords := make(map[string][]*NSRecord)
 
 	records, err := t.GetRecords()
 	if err != nil {
 		return err
 	}
 
+	// lines is used to compute a digest of the records so that changes can be detected
+	var lines []string
+
+	// names is an index of every name that exists in any record type
+	names := make(map[string]bool)
+
+	// macs is an index of the MAC of the A and AAAA records by IP
+	macs := make(map[string]string)
+
+	addMAC := func(r *ARecord) {
+		if r.MAC == "" {
+			return
+		}
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			zap.L().Debug(fmt.Sprintf("Record %s has an invalid MAC %s", r.GetKey(), r.MAC))
+			return
+		}
+		if ip := net.ParseIP(r.IP); ip != nil {
+			macs[ip.String()] = mac.String()
+		}
+	}
+
+	addName := func(name string) {
+		name = strings.ToLower(name)
+		names[name] = true
+		// Parent names of an existing name also exist (empty non-terminals)
+		for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+			names[name[i:]] = true
+		}
+	}
+
 	if records.ARecords != nil {
 		for _, r := range records.ARecords {
 			r = r.Clone()
+			if r.TTL <= 0 {
+				r.TTL = t.GetTTL()
+			}
 			if r.Domain == "" {
 				r.Domain = t.GetDomainName()
 			}
 			if logger.Trace {
 				zap.L().Debug(fmt.Sprintf("Loading %s record with key %s and value %s", "A", r.GetKey(), r.GetValue()))
 			}
-			aRecords[r.GetKey()] = r
+			lines = append(lines, "A "+r.GetKey()+" "+r.GetValue())
+			addName(r.GetKey())
+			addMAC(r)
+			key := strings.ToLower(r.GetKey())
+			aRecords[key] = appendARecord(aRecords[key], r)
 		}
 	}
 
 	if records.AAAARecords != nil {
 		for _, r := range records.AAAARecords {
 			r = r.Clone()
+			if r.TTL <= 0 {
+				r.TTL = t.GetTTL()
+			}
 			if r.Domain == "" {
 				r.Domain = t.GetDomainName()
 			}
 			if logger.Trace {
 				zap.L().Debug(fmt.Sprintf("Loading %s record with key %s and value %s", "AAAA", r.GetKey(), r.GetValue()))
 			}
-			aaaRecords[r.GetKey()] = r
+			lines = append(lines, "AAAA "+r.GetKey()+" "+r.GetValue())
+			addName(r.GetKey())
+			addMAC(r)
+			key := strings.ToLower(r.GetKey())
+			aaaRecords[key] = appendARecord(aaaRecords[key], r)
 		}
 	}
 
 	if records.PtrRecords != nil {
 		for _, r := range records.PtrRecords {
 			r = r.Clone()
+			if r.TTL <= 0 {
+				r.TTL = t.GetTTL()
+			}
 			if r.Domain == "" {
 				r.Domain = t.GetDomainName()
 			}
 			if logger.Trace {
 				zap.L().Debug(fmt.Sprintf("Loading %s record with key %s and value %s", "PTR", r.GetKey(), r.GetValue()))
 			}
-			ptrRecords[r.GetKey()] = r
+			lines = append(lines, "PTR "+r.GetKey()+" "+r.GetValue())
+			addName(r.GetKey())
+			ptrRecords[strings.ToLower(r.GetKey())] = r
 		}
 	}
 
 	if records.CnameRecords != nil {
 		for _, r := range records.CnameRecords {
 			r = r.Clone()
+			if r.TTL <= 0 {
+				r.TTL = t.GetTTL()
+			}
 			if r.AliasDomain == "" {
 				r.AliasDomain = t.GetDomainName()
 			}
@@ -262,17 +435,136 @@ func (t *Client) refresh() error {
 			if logger.Trace {
 				zap.L().Debug(fmt.Sprintf("Loading %s record with key %s and value %s", "CNAME", r.GetKey(), r.GetValue()))
 			}
-			cnameRecords[r.GetKey()] = r
+			lines = append(lines, "CNAME "+r.GetKey()+" "+r.GetValue())
+			addName(r.GetKey())
+			cnameRecords[strings.ToLower(r.GetKey())] = r
+		}
+	}
+
+	if records.MxRecords != nil {
+		for _, r := range records.MxRecords {
+			r = r.Clone()
+			if r.TTL <= 0 {
+				r.TTL = t.GetTTL()
+			}
+			if r.Domain == "" {
+				r.Domain = t.GetDomainName()
+			}
+			if r.TargetDomain == "" {
+				r.TargetDomain = t.GetDomainName()
+			}
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Loading %s record with key %s and value %s", "MX", r.GetKey(), r.GetValue()))
+			}
+			lines = append(lines, fmt.Sprintf("MX %s %d %s", r.GetKey(), r.Preference, r.GetValue()))
+			addName(r.GetKey())
+			key := strings.ToLower(r.GetKey())
+			mxRecords[key] = append(mxRecords[key], r)
+		}
+	}
+
+	if records.TxtRecords != nil {
+		for _, r := range records.TxtRecords {
+			r = r.Clone()
+			if r.TTL <= 0 {
+				r.TTL = t.GetTTL()
+			}
+			if r.Domain == "" {
+				r.Domain = t.GetDomainName()
+			}
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Loading %s record with key %s and value %s", "TXT", r.GetKey(), strings.Join(r.GetValue(), " ")))
+			}
+			lines = append(lines, "TXT "+r.GetKey()+" "+strings.Join(r.GetValue(), " "))
+			addName(r.GetKey())
+			key := strings.ToLower(r.GetKey())
+			txtRecords[key] = append(txtRecords[key], r)
+		}
+	}
+
+	if records.SrvRecords != nil {
+		for _, r := range records.SrvRecords {
+			r = r.Clone()
+			if r.TTL <= 0 {
+				r.TTL = t.GetTTL()
+			}
+			if r.Domain == "" {
+				r.Domain = t.GetDomainName()
+			}
+			if r.TargetDomain == "" {
+				r.TargetDomain = t.GetDomainName()
+			}
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Loading %s record with key %s and value %s", "SRV", r.GetKey(), r.GetValue()))
+			}
+			lines = append(lines, fmt.Sprintf("SRV %s %d %d %d %s", r.GetKey(), r.Priority, r.Weight, r.Port, r.GetValue()))
+			addName(r.GetKey())
+			key := strings.ToLower(r.GetKey())
+			srvRecords[key] = append(srvRecords[key], r)
+		}
+	}
+
+	if records.NsRecords != nil {
+		for _, r := range records.NsRecords {
+			r = r.Clone()
+			if r.TTL <= 0 {
+				r.TTL = t.GetTTL()
+			}
+			if r.Domain == "" {
+				r.Domain = t.GetDomainName()
+			}
+			if r.TargetDomain == "" {
+				r.TargetDomain = t.GetDomainName()
+			}
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Loading %s record with key %s and value %s", "NS", r.GetKey(), r.GetValue()))
+			}
+			lines = append(lines, "NS "+r.GetKey()+" "+r.GetValue())
+			addName(r.GetKey())
+			key := strings.ToLower(r.GetKey())
+			nsRecords[key] = append(nsRecords[key], r)
 		}
 	}
 
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	digest := hex.EncodeToString(sum[:])
+
 	t.mutex.Lock()
-	defer t.mutex.Unlock()
 
+	if t.digest != "" && t.digest != digest {
+		t.generation++
+		zap.L().Debug(fmt.Sprintf("Records for %s changed, generation is now %d", t.GetName(), t.generation))
+	}
+
+	t.digest = digest
+	t.names = names
+	t.macs = macs
 	t.aRecords = aRecords
 	t.aaaaRecords = aaaRecords
 	t.ptrRecords = ptrRecords
 	t.cnameRecords = cnameRecords
+	t.mxRecords = mxRecords
+	t.txtRecords = txtRecords
+	t.srvRecords = srvRecords
+	t.nsRecords = nsRecords
+
+	t.mutex.Unlock()
+
+	if t.onRefresh != nil {
+		t.onRefresh()
+	}
 
 	return nil
 }
+
+// appendARecord appends the record to the record set unless the set already
+// has a record with the same IP
+func appendARecord(recordSet []*ARecord, record *ARecord) []*ARecord {
+	for _, existing := range recordSet {
+		if existing.GetValue() == record.GetValue() {
+			return recordSet
+		}
+	}
+	return append(recordSet, record)
+}
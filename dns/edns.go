@@ -0,0 +1,120 @@
+package dns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// serveDNS is the handler for every listener. The response of whichever handler
+// answers is written through an ednsWriter so EDNS0 (RFC 6891) is applied to
+// every response.
+func (t *Server) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+
+	// The view is picked before anything else so the whole query is answered
+	// from the domains of the view
+	if v := t.getView(w); v != nil {
+		v.server.serveDNS(w, r)
+		return
+	}
+
+	ew := &ednsWriter{
+		ResponseWriter: w,
+		req:            r,
+		bufferSize:     t.ednsBufferSize,
+	}
+
+	// Only version 0 of EDNS is supported
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeBadVers)
+		ew.WriteMsg(m)
+		return
+	}
+
+	// The request is validated here as the mux refuses names it has no handler
+	// for, so the handlers can rely on a query with exactly one question
+	if !t.validRequest(ew, r) {
+		return
+	}
+
+	if t.rpz != nil {
+
+		// Policy answers are neither local nor forwarded so a client that is
+		// allowed neither is refused before they are applied
+		if !t.allowsRecursion(w) && !t.allowsLocalAnswers(w) {
+			t.refuse(ew, r)
+			return
+		}
+
+		t.serveRPZ(ew, r)
+		return
+	}
+
+	t.mux.ServeDNS(ew, r)
+}
+
+// ednsWriter echoes an OPT record with our buffer size if the request had one
+// and truncates UDP responses to the size the client can receive, setting TC
+// so the client retries over TCP.
+type ednsWriter struct {
+	dns.ResponseWriter
+	req        *dns.Msg
+	bufferSize uint16
+}
+
+func (t *ednsWriter) WriteMsg(m *dns.Msg) error {
+
+	// The OPT record is hop by hop so one from a nameserver is not passed on
+	removeOPT(m)
+
+	size := dns.MinMsgSize
+
+	if opt := t.req.IsEdns0(); opt != nil {
+		m.SetEdns0(t.bufferSize, opt.Do())
+		size = int(opt.UDPSize())
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+		if size > int(t.bufferSize) {
+			size = int(t.bufferSize)
+		}
+	}
+
+	if _, ok := t.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(size)
+	}
+
+	return t.ResponseWriter.WriteMsg(m)
+}
+
+// removeOPT removes any OPT record from the additional section
+func removeOPT(m *dns.Msg) {
+
+	extra := m.Extra[:0]
+
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+
+	m.Extra = extra
+}
+
+// withEDNS returns a copy of the request with an OPT record advertising our
+// buffer size to the nameservers. The DO bit of the client is kept.
+func (t *Server) withEDNS(r *dns.Msg) *dns.Msg {
+
+	req := r.Copy()
+
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+		removeOPT(req)
+	}
+
+	req.SetEdns0(t.ednsBufferSize, do)
+
+	return req
+}
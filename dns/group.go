@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	logger "github.com/jodydadescott/jody-go-logger"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// clientGroup is a group of clients with their own blocklist, nameservers and
+// local domains. If hasBlocklist is false the global blocklist is used and if
+// forwarder is nil the global nameservers are used.
+type clientGroup struct {
+	name              string
+	networks          []*net.IPNet
+	macs              map[string]bool
+	hasBlocklist      bool
+	blocklist         *blocklist
+	forwarder         *forwarder
+	cache             *cache
+	disableForwarding bool
+	localDomains      []string
+}
+
+func newClientGroup(config *ClientGroupConfig, upstream *UpstreamConfig, cacheConfig *CacheConfig) *clientGroup {
+
+	if config == nil {
+		panic("config is required")
+	}
+
+	if config.Name == "" {
+		panic("client group requires a name")
+	}
+
+	if len(config.CIDRs) <= 0 && len(config.IPs) <= 0 && len(config.MACs) <= 0 {
+		panic(fmt.Sprintf("client group %s requires CIDRs, IPs or MACs", config.Name))
+	}
+
+	if config.DisableForwarding && len(config.Nameservers) > 0 {
+		panic(fmt.Sprintf("client group %s can not disable forwarding and have nameservers", config.Name))
+	}
+
+	g := &clientGroup{
+		name:              config.Name,
+		macs:              make(map[string]bool),
+		disableForwarding: config.DisableForwarding,
+	}
+
+	for _, cidr := range config.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(fmt.Sprintf("client group %s CIDR %s is invalid", config.Name, cidr))
+		}
+		g.networks = append(g.networks, network)
+	}
+
+	for _, v := range config.IPs {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			panic(fmt.Sprintf("client group %s IP %s is invalid", config.Name, v))
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		g.networks = append(g.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	for _, v := range config.MACs {
+		mac, err := net.ParseMAC(v)
+		if err != nil {
+			panic(fmt.Sprintf("client group %s MAC %s is invalid", config.Name, v))
+		}
+		g.macs[mac.String()] = true
+	}
+
+	if config.Blocklist != nil {
+		g.hasBlocklist = true
+		if config.Blocklist.Enabled {
+			g.blocklist = newBlocklist(config.Blocklist)
+		}
+	}
+
+	if len(config.Nameservers) > 0 {
+
+		if config.Upstream != nil {
+			upstream = config.Upstream
+		}
+
+		g.forwarder = newForwarder(".", config.Nameservers, upstream)
+
+		// Answers from other nameservers are not shared with the global cache
+		if cacheConfig != nil && cacheConfig.Enabled {
+			g.cache = newCache(cacheConfig)
+		}
+	}
+
+	for _, domain := range config.LocalDomains {
+		g.localDomains = append(g.localDomains, dns.Fqdn(strings.ToLower(domain)))
+	}
+
+	return g
+}
+
+func (t *clientGroup) containsIP(ip net.IP) bool {
+
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getClientGroup returns the group of the client with the address or nil if it
+// is not in a group
+func (t *Server) getClientGroup(addr net.Addr) *clientGroup {
+
+	if len(t.clientGroups) <= 0 {
+		return nil
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	mac := ""
+	macResolved := false
+
+	for _, g := range t.clientGroups {
+
+		if g.containsIP(ip) {
+			return g
+		}
+
+		if len(g.macs) > 0 {
+			if !macResolved {
+				mac = t.getMAC(ip.String())
+				macResolved = true
+			}
+			if g.macs[mac] {
+				if logger.Trace {
+					zap.L().Debug(fmt.Sprintf("Client %s with MAC %s is in group %s", ip.String(), mac, g.name))
+				}
+				return g
+			}
+		}
+	}
+
+	return nil
+}
+
+// getMAC returns the MAC of the host with the IP from the records of the
+// providers or an empty string
+func (t *Server) getMAC(ip string) string {
+
+	for _, client := range t.clients {
+		if mac := client.getMAC(ip); mac != "" {
+			return mac
+		}
+	}
+
+	return ""
+}
+
+// getBlocklist returns the blocklist for the group or nil if names are not
+// blocked
+func (t *Server) getBlocklist(g *clientGroup) *blocklist {
+	if g != nil && g.hasBlocklist {
+		return g.blocklist
+	}
+	return t.blocklist
+}
+
+// getCache returns the cache for the group or nil if caching is not enabled
+func (t *Server) getCache(g *clientGroup) *cache {
+	if g != nil && g.forwarder != nil {
+		return g.cache
+	}
+	return t.cache
+}
+
+// getClientForwarder returns the most specific forwarder for the name and
+// group or nil. The nameservers of the group replace the global nameservers.
+func (t *Server) getClientForwarder(g *clientGroup, name string) *forwarder {
+
+	f := t.getForwarder(name)
+
+	if g == nil {
+		return f
+	}
+
+	if g.disableForwarding {
+		return nil
+	}
+
+	if g.forwarder != nil && (f == nil || f.name == ".") {
+		return g.forwarder
+	}
+
+	return f
+}
+
+// allowsLocal returns true if the group may be answered for the local name
+func (t *Server) allowsLocal(g *clientGroup, name string) bool {
+
+	if g == nil || len(g.localDomains) <= 0 {
+		return true
+	}
+
+	name = strings.ToLower(name)
+
+	for _, domain := range g.localDomains {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refuse writes a REFUSED response
+func (t *Server) refuse(w dns.ResponseWriter, r *dns.Msg) {
+
+	if logger.Trace {
+		zap.L().Debug(fmt.Sprintf("Refusing %s for %s", r.Question[0].Name, w.RemoteAddr().String()))
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
@@ -0,0 +1,583 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/jodydadescott/jody-go-logger"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// getTTL returns the TTL in seconds. Records without their own TTL or a provider
+// TTL use the server TTL.
+func (t *Server) getTTL(ttl time.Duration) uint32 {
+	if ttl <= 0 {
+		ttl = t.ttl
+	}
+	return uint32(ttl.Seconds())
+}
+
+// rotate returns the records rotated by one more position than the previous call
+// if round robin is enabled, otherwise the records are returned as is
+func (t *Server) rotate(rrs []dns.RR) []dns.RR {
+
+	if !t.roundRobin || len(rrs) <= 1 {
+		return rrs
+	}
+
+	offset := int(atomic.AddUint32(&t.rotation, 1) % uint32(len(rrs)))
+	rotated := make([]dns.RR, 0, len(rrs))
+	rotated = append(rotated, rrs[offset:]...)
+	return append(rotated, rrs[:offset]...)
+}
+
+// hasName returns true if any client has the name in any record type
+func (t *Server) hasName(name string) bool {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		if client.hasName(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveWildcard returns the wildcard name that the name is synthesized from per
+// RFC 4592 or the name itself. A wildcard only matches if the name does not exist
+// and the wildcard is a child of the closest existing ancestor (closest encloser).
+func (t *Server) resolveWildcard(name string) string {
+
+	name = strings.ToLower(name)
+
+	z := t.getZone(name)
+	if z == nil || t.hasName(name) {
+		return name
+	}
+
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+
+		encloser := name[i:]
+
+		if !dns.IsSubDomain(z.name, encloser) {
+			break
+		}
+
+		if z.isApex(encloser) || t.hasName(encloser) {
+			wildcard := "*." + encloser
+			if t.hasName(wildcard) {
+				if logger.Trace {
+					zap.L().Debug(fmt.Sprintf("%s is synthesized from wildcard %s", name, wildcard))
+				}
+				return wildcard
+			}
+			break
+		}
+	}
+
+	return name
+}
+
+func (t *Server) getARecords(name string) []*ARecord {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		r := client.getARecords(name)
+		if len(r) > 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *Server) getAAAARecords(name string) []*ARecord {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		r := client.getAAAARecords(name)
+		if len(r) > 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *Server) getPTRRecord(name string) *PTRrecord {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		r := client.getPTRRecord(name)
+		if r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *Server) getCNameRecord(name string) *CNameRecord {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		r := client.getCNameRecord(name)
+		if r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *Server) getMXRecords(name string) []*MXRecord {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		r := client.getMXRecords(name)
+		if len(r) > 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *Server) getTXTRecords(name string) []*TXTRecord {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		r := client.getTXTRecords(name)
+		if len(r) > 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *Server) getSRVRecords(name string) []*SRVRecord {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		r := client.getSRVRecords(name)
+		if len(r) > 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *Server) getNSRecords(name string) []*NSRecord {
+
+	name = strings.ToLower(name)
+
+	for _, client := range t.clients {
+		r := client.getNSRecords(name)
+		if len(r) > 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+// validRequest writes an error response and returns false if the request is not
+// a query with exactly one question
+func (t *Server) validRequest(w dns.ResponseWriter, r *dns.Msg) bool {
+
+	rcode := dns.RcodeSuccess
+
+	switch {
+
+	case r.Opcode != dns.OpcodeQuery:
+		rcode = dns.RcodeNotImplemented
+
+	case len(r.Question) != 1:
+		rcode = dns.RcodeFormatError
+
+	default:
+		return true
+
+	}
+
+	if logger.Trace {
+		zap.L().Debug(fmt.Sprintf("rejecting request with opcode %s and %d questions", dns.OpcodeToString[r.Opcode], len(r.Question)))
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	w.WriteMsg(m)
+	return false
+}
+
+// forward sends the request to the nameservers of the most specific forwarder
+// for the client group
+func (t *Server) forward(g *clientGroup, r *dns.Msg) (*dns.Msg, error) {
+
+	f := t.getClientForwarder(g, r.Question[0].Name)
+	if f == nil {
+		return nil, fmt.Errorf("forwarding is not enabled for %s", r.Question[0].Name)
+	}
+
+	return f.exchange(t.withEDNS(r))
+}
+
+// exchange returns the response for the request from the cache or from the
+// nameservers. Responses from the nameservers are added to the cache. If the
+// nameservers fail an expired response is returned if serve stale is enabled.
+// A client group with its own nameservers has its own cache.
+func (t *Server) exchange(g *clientGroup, r *dns.Msg) (*dns.Msg, error) {
+
+	c := t.getCache(g)
+
+	if c != nil {
+		if resp, prefetch := c.get(r); resp != nil {
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Answered %s from cache", r.Question[0].Name))
+			}
+			if prefetch {
+				go t.prefetch(g, c, r.Copy())
+			}
+			return resp, nil
+		}
+	}
+
+	resp, err := t.forward(g, r)
+	if err != nil {
+		if c != nil {
+			if stale := c.getStale(r); stale != nil {
+				zap.L().Debug(fmt.Sprintf("Answered %s from stale cache: %s", r.Question[0].Name, err.Error()))
+				return stale, nil
+			}
+		}
+		return nil, err
+	}
+
+	if c != nil {
+		c.set(r, resp)
+	}
+
+	return resp, nil
+}
+
+// prefetch refreshes the cached response for the request before it expires
+func (t *Server) prefetch(g *clientGroup, c *cache, r *dns.Msg) {
+
+	if logger.Trace {
+		zap.L().Debug(fmt.Sprintf("Prefetching %s", r.Question[0].Name))
+	}
+
+	resp, err := t.forward(g, r)
+	if err != nil {
+		c.prefetchFailed(r)
+		if logger.Trace {
+			zap.L().Debug(err.Error())
+		}
+		return
+	}
+
+	c.set(r, resp)
+}
+
+func (t *Server) handleRemote(w dns.ResponseWriter, r *dns.Msg) {
+
+	if !t.allowsRecursion(w) {
+		t.refuse(w, r)
+		return
+	}
+
+	g := t.getClientGroup(w.RemoteAddr())
+
+	if t.getClientForwarder(g, r.Question[0].Name) == nil {
+		t.refuse(w, r)
+		return
+	}
+
+	if t.block(g, w, r) {
+		return
+	}
+
+	resp, err := t.exchange(g, r)
+	if err == nil {
+		if t.blockedCNAME(g, resp) {
+			w.WriteMsg(t.getBlocklist(g).reply(r))
+			return
+		}
+		resp.Compress = true
+		w.WriteMsg(resp)
+		return
+	}
+
+	if logger.Trace {
+		zap.L().Debug(err.Error())
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+// lookupRecords returns the local records for the name and type
+func (t *Server) lookupRecords(name string, qtype uint16) []dns.RR {
+
+	var rrs []dns.RR
+
+	z := t.getZone(name)
+
+	// key is the name the records are stored under which differs from the name
+	// when it is synthesized from a wildcard
+	key := t.resolveWildcard(name)
+
+	answer := func(record, src string) {
+
+		if logger.Trace {
+			zap.L().Debug(fmt.Sprintf("success -> %s, source=%s", record, src))
+		}
+
+		rr, err := dns.NewRR(record)
+
+		if err == nil {
+			rrs = append(rrs, rr)
+		} else {
+			zap.L().Error(err.Error())
+		}
+	}
+
+	switch qtype {
+
+	case dns.TypeA:
+		lookup := t.getARecords(key)
+		for _, v := range lookup {
+			answer(fmt.Sprintf("%s %d A %s", name, t.getTTL(v.TTL), v.GetValue()), v.SRC)
+		}
+		if len(lookup) <= 0 && logger.Trace {
+			zap.L().Debug(fmt.Sprintf("fail -> %s has no A record", name))
+		}
+		rrs = t.rotate(rrs)
+
+	case dns.TypeAAAA:
+		lookup := t.getAAAARecords(key)
+		for _, v := range lookup {
+			answer(fmt.Sprintf("%s %d AAAA %s", name, t.getTTL(v.TTL), v.GetValue()), v.SRC)
+		}
+		if len(lookup) <= 0 && logger.Trace {
+			zap.L().Debug(fmt.Sprintf("fail -> %s has no AAAA record", name))
+		}
+		rrs = t.rotate(rrs)
+
+	case dns.TypePTR:
+		lookup := t.getPTRRecord(key)
+		if lookup != nil {
+			answer(fmt.Sprintf("%s %d PTR %s", name, t.getTTL(lookup.TTL), lookup.GetValue()), lookup.SRC)
+		} else if logger.Trace {
+			zap.L().Debug((fmt.Sprintf("fail -> %s has no PTR record", name)))
+		}
+
+	case dns.TypeCNAME:
+		lookup := t.getCNameRecord(key)
+		if lookup != nil {
+			answer(fmt.Sprintf("%s %d CNAME %s", name, t.getTTL(lookup.TTL), lookup.GetValue()), lookup.SRC)
+		} else if logger.Trace {
+			zap.L().Debug((fmt.Sprintf("fail -> %s has no CNAME record", name)))
+		}
+
+	case dns.TypeMX:
+		lookup := t.getMXRecords(key)
+		for _, v := range lookup {
+			answer(fmt.Sprintf("%s %d MX %d %s", name, t.getTTL(v.TTL), v.Preference, v.GetValue()), v.SRC)
+		}
+		if len(lookup) <= 0 && logger.Trace {
+			zap.L().Debug((fmt.Sprintf("fail -> %s has no MX record", name)))
+		}
+
+	case dns.TypeTXT:
+		lookup := t.getTXTRecords(key)
+		for _, v := range lookup {
+			answer(fmt.Sprintf("%s %d TXT %s", name, t.getTTL(v.TTL), quoteTXT(v.GetValue())), v.SRC)
+		}
+		if len(lookup) <= 0 && logger.Trace {
+			zap.L().Debug((fmt.Sprintf("fail -> %s has no TXT record", name)))
+		}
+
+	case dns.TypeSRV:
+		lookup := t.getSRVRecords(key)
+		for _, v := range lookup {
+			answer(fmt.Sprintf("%s %d SRV %d %d %d %s", name, t.getTTL(v.TTL), v.Priority, v.Weight, v.Port, v.GetValue()), v.SRC)
+		}
+		if len(lookup) <= 0 && logger.Trace {
+			zap.L().Debug((fmt.Sprintf("fail -> %s has no SRV record", name)))
+		}
+
+	case dns.TypeNS:
+		lookup := t.getNSRecords(key)
+		for _, v := range lookup {
+			answer(fmt.Sprintf("%s %d NS %s", name, t.getTTL(v.TTL), v.GetValue()), v.SRC)
+		}
+		if len(lookup) <= 0 && z != nil && z.isApex(name) {
+			rrs = append(rrs, z.getNS()...)
+		} else if len(lookup) <= 0 && logger.Trace {
+			zap.L().Debug((fmt.Sprintf("fail -> %s has no NS record", name)))
+		}
+
+	case dns.TypeANY:
+		// Per RFC 8482 a single synthesized HINFO record is returned instead of
+		// every record type. A CNAME is returned as is.
+		if lookup := t.getCNameRecord(key); lookup != nil {
+			answer(fmt.Sprintf("%s %d CNAME %s", name, t.getTTL(lookup.TTL), lookup.GetValue()), lookup.SRC)
+		} else if (z != nil && z.isApex(name)) || t.hasName(key) {
+			answer(fmt.Sprintf("%s %d HINFO \"RFC8482\" \"\"", name, t.getTTL(0)), "rfc8482")
+		}
+
+	case dns.TypeSOA:
+		if z != nil && z.isApex(name) {
+			rrs = append(rrs, z.getSOA())
+		} else if logger.Trace {
+			zap.L().Debug((fmt.Sprintf("fail -> %s has no SOA record", name)))
+		}
+
+	}
+
+	return rrs
+}
+
+func (t *Server) handleLocal(w dns.ResponseWriter, r *dns.Msg) {
+
+	if !t.allowsLocalAnswers(w) {
+		t.refuse(w, r)
+		return
+	}
+
+	g := t.getClientGroup(w.RemoteAddr())
+
+	if !t.allowsLocal(g, r.Question[0].Name) {
+		t.refuse(w, r)
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Compress = false
+	m.Authoritative = true
+
+	q := m.Question[0]
+
+	name := q.Name
+	visited := make(map[string]bool)
+	forwarded := false
+
+	// Follow the CNAME chain unless the CNAME itself or ANY was asked for. If the
+	// target is not local the remainder of the chain is resolved upstream.
+	for q.Qtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+
+		cname := t.getCNameRecord(t.resolveWildcard(name))
+		if cname == nil {
+			break
+		}
+
+		visited[strings.ToLower(name)] = true
+
+		answer := fmt.Sprintf("%s %d CNAME %s", name, t.getTTL(cname.TTL), cname.GetValue())
+
+		if logger.Trace {
+			zap.L().Debug(fmt.Sprintf("success -> %s, source=%s", answer, cname.SRC))
+		}
+
+		rr, err := dns.NewRR(answer)
+		if err != nil {
+			zap.L().Error(err.Error())
+			break
+		}
+
+		m.Answer = append(m.Answer, rr)
+		name = cname.GetValue()
+
+		if visited[strings.ToLower(name)] || len(visited) >= maxCNameDepth {
+			zap.L().Debug(fmt.Sprintf("CNAME chain for %s is looped or too long", q.Name))
+			m.Rcode = dns.RcodeServerFailure
+			w.WriteMsg(m)
+			return
+		}
+
+		if !t.isLocal(name) {
+			forwarded = true
+			break
+		}
+	}
+
+	if forwarded {
+
+		// A local CNAME to a blocked name is blocked as it is for forwarded names
+		if b := t.getBlocklist(g); b != nil && b.blocked(name) {
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("%s is blocked by CNAME %s", q.Name, name))
+			}
+			w.WriteMsg(b.reply(r))
+			return
+		}
+
+		// Without upstream nameservers or recursion the CNAME is returned on its own
+		if t.getClientForwarder(g, name) != nil && t.allowsRecursion(w) {
+			req := new(dns.Msg)
+			req.SetQuestion(name, q.Qtype)
+			resp, err := t.exchange(g, req)
+			if err == nil && t.blockedCNAME(g, resp) {
+				w.WriteMsg(t.getBlocklist(g).reply(r))
+				return
+			}
+			if err == nil {
+				m.Answer = append(m.Answer, resp.Answer...)
+				m.Rcode = resp.Rcode
+			} else {
+				m.Rcode = dns.RcodeServerFailure
+			}
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	rrs := t.lookupRecords(name, q.Qtype)
+	m.Answer = append(m.Answer, rrs...)
+
+	z := t.getZone(name)
+
+	if len(m.Answer) <= 0 && t.fallsThrough(z, q.Qtype) && t.getClientForwarder(g, q.Name) != nil && t.allowsRecursion(w) {
+		if logger.Trace {
+			zap.L().Debug(fmt.Sprintf("%s has no local answer, falling through to nameservers", q.Name))
+		}
+		t.handleRemote(w, r)
+		return
+	}
+
+	// Negative answers include the SOA so that resolvers can cache them. If the
+	// name does not exist in any record type the answer is NXDOMAIN, otherwise
+	// it is NODATA. When a CNAME chain was followed this applies to the target.
+	if len(rrs) <= 0 && z != nil {
+		if !z.isApex(name) && !t.hasName(t.resolveWildcard(name)) {
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("fail -> %s does not exist", name))
+			}
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = append(m.Ns, z.getSOA())
+	}
+
+	w.WriteMsg(m)
+}
+
+// quoteTXT returns the TXT character strings in zone file presentation format
+func quoteTXT(text []string) string {
+	var quoted []string
+	for _, v := range text {
+		v = strings.ReplaceAll(v, `\`, `\\`)
+		v = strings.ReplaceAll(v, `"`, `\"`)
+		quoted = append(quoted, `"`+v+`"`)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+
+	"github.com/jodydadescott/home-dns-server/types"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+)
+
+// newHTTPSClient returns the client for a DNS over HTTPS (RFC 8484) nameserver.
+// Connections are kept alive with HTTP/2 pings. If the IP is set it is dialed
+// instead of resolving the host in the URL so that the nameserver can be
+// reached without depending on DNS.
+func newHTTPSClient(netPort *NetPort, endpoint *url.URL, timeout time.Duration) *http.Client {
+
+	transport := &http.Transport{
+		TLSClientConfig:   newTLSConfig(netPort),
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   time.Minute * 5,
+	}
+
+	if netPort.IP != "" {
+		port := endpoint.Port()
+		if port == "" {
+			port = "443"
+		}
+		address := net.JoinHostPort(netPort.IP, port)
+		dialer := &net.Dialer{Timeout: timeout}
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		}
+	}
+
+	h2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		panic(err)
+	}
+
+	h2.ReadIdleTimeout = types.DefaultDoHKeepalive
+	h2.PingTimeout = timeout
+
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// parseHTTPSEndpoint returns the URL of a HTTPS nameserver
+func parseHTTPSEndpoint(netPort *NetPort) *url.URL {
+
+	if netPort.URL == "" {
+		panic("URL is required for HTTPS nameserver")
+	}
+
+	endpoint, err := url.Parse(netPort.URL)
+	if err != nil {
+		panic(fmt.Sprintf("URL %s is invalid; error is %s", netPort.URL, err.Error()))
+	}
+
+	if endpoint.Scheme != "https" {
+		panic(fmt.Sprintf("URL %s must be https", netPort.URL))
+	}
+
+	switch strings.ToUpper(netPort.Method) {
+
+	case http.MethodGet, http.MethodPost:
+		netPort.Method = strings.ToUpper(netPort.Method)
+
+	case "":
+		netPort.Method = http.MethodPost
+
+	default:
+		panic(fmt.Sprintf("Method %s is invalid", netPort.Method))
+	}
+
+	return endpoint
+}
+
+// exchangeHTTPS sends the request to the HTTPS nameserver in wire format
+func (t *upstream) exchangeHTTPS(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+
+	// The ID is zero so that the response is cache friendly (RFC 8484 4.1)
+	m := r.Copy()
+	m.Id = 0
+
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var req *http.Request
+
+	if t.netPort.Method == http.MethodGet {
+		endpoint := *t.endpoint
+		query := endpoint.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		endpoint.RawQuery = query.Encode()
+		req, err = http.NewRequest(http.MethodGet, endpoint.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, t.endpoint.String(), bytes.NewReader(buf))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageContentType)
+		}
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	start := time.Now()
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("nameserver %s responded with HTTP status %s", t.address, strconv.Itoa(resp.StatusCode))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rtt := time.Since(start)
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+
+	msg.Id = r.Id
+
+	return msg, rtt, nil
+}
@@ -0,0 +1,801 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	logger "github.com/jodydadescott/jody-go-logger"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	rpzIPSuffix       = ".rpz-ip."
+	rpzNSDNameSuffix  = ".rpz-nsdname."
+	rpzNSIPSuffix     = ".rpz-nsip."
+	rpzClientIPSuffix = ".rpz-client-ip."
+
+	// NS lookups for NSDNAME triggers are cached for the TTL of the NS records
+	// up to rpzNSMaxTTL. Lookups that find no NS records are cached for
+	// rpzNSNegativeTTL. The cache is cleared when it reaches rpzNSCacheSize.
+	rpzNSMaxTTL      = time.Hour
+	rpzNSNegativeTTL = 5 * time.Minute
+	rpzNSCacheSize   = 10000
+)
+
+// rpzAction is what a policy does with a query that triggers it
+type rpzAction int
+
+const (
+	rpzRewrite rpzAction = iota
+	rpzNXDomain
+	rpzNoData
+	rpzPassthru
+	rpzDrop
+)
+
+// rpzPolicy is the action for a trigger. For rpzRewrite the records are the
+// local data that is returned instead of the answer.
+type rpzPolicy struct {
+	zone    *rpzZone
+	trigger string
+	action  rpzAction
+	records []dns.RR
+}
+
+// rpzNSNames is a cached NS lookup
+type rpzNSNames struct {
+	names   []string
+	expires time.Time
+}
+
+type rpzIPPolicy struct {
+	network *net.IPNet
+	prefix  int
+	policy  *rpzPolicy
+}
+
+// rpzZone is a loaded Response Policy Zone. QNAME and NSDNAME triggers are kept
+// by name, wildcard triggers under their *. name.
+type rpzZone struct {
+	name     string
+	soa      *dns.SOA
+	qnames   map[string]*rpzPolicy
+	nsdnames map[string]*rpzPolicy
+	ips      []*rpzIPPolicy
+}
+
+// rpz holds the policy zones in the order they are configured. The zones are
+// reloaded on the same ticker pattern as the provider clients.
+type rpz struct {
+	mutex           sync.RWMutex
+	ticker          *xticker
+	done            chan bool
+	configs         []*RPZZoneConfig
+	refreshDuration time.Duration
+
+	// loaded holds each zone by name so a zone that fails to load keeps the
+	// policies from the last successful load
+	loaded map[string]*rpzZone
+	zones  []*rpzZone
+
+	// nsNames caches the NS lookups for NSDNAME triggers by client group and name
+	nsMutex sync.Mutex
+	nsNames map[string]*rpzNSNames
+}
+
+func newRPZ(config *RPZConfig) *rpz {
+
+	if config == nil {
+		panic("config is required")
+	}
+
+	config = config.Clone()
+
+	r := &rpz{
+		refreshDuration: config.Refresh,
+		loaded:          make(map[string]*rpzZone),
+		nsNames:         make(map[string]*rpzNSNames),
+	}
+
+	names := make(map[string]bool)
+
+	for _, zoneConfig := range config.Zones {
+
+		if zoneConfig == nil {
+			panic("nil RPZ zone")
+		}
+
+		if !zoneConfig.Enabled {
+			zap.L().Debug(fmt.Sprintf("RPZ zone %s is not enabled", zoneConfig.GetName()))
+			continue
+		}
+
+		if zoneConfig.Path == "" {
+			panic(fmt.Sprintf("RPZ zone %s requires a path", zoneConfig.GetName()))
+		}
+
+		if names[zoneConfig.GetName()] {
+			panic(fmt.Sprintf("RPZ zone %s is defined more than once", zoneConfig.GetName()))
+		}
+		names[zoneConfig.GetName()] = true
+
+		r.configs = append(r.configs, zoneConfig)
+	}
+
+	return r
+}
+
+func (t *rpz) run() error {
+
+	tick := func() {
+		zap.L().Debug("Running refresh for RPZ zones")
+		err := t.refresh()
+
+		if err == nil {
+			t.ticker.reset(t.refreshDuration)
+			return
+		}
+
+		zap.L().Error(fmt.Sprintf("Error on RPZ zones, setting retry interval to low; error is %s", err.Error()))
+		t.ticker.reset(errRefreshDuration)
+	}
+
+	if t.refreshDuration <= 0 {
+		zap.L().Info("Refresh for RPZ zones is not enabled")
+		return t.refresh()
+	}
+
+	zap.L().Info(fmt.Sprintf("Refresh for RPZ zones is %s", t.refreshDuration.String()))
+
+	t.done = make(chan bool)
+	t.ticker = &xticker{}
+	tick()
+
+	done := t.done
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-t.ticker.ticker.C:
+				tick()
+
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *rpz) shutdown() {
+
+	zap.L().Info("Shutting down RPZ zones")
+
+	if t.ticker != nil {
+		t.ticker.stop()
+	}
+
+	// The channel is closed rather than sent on so shutdown does not wait for
+	// a refresh in progress
+	if t.done != nil {
+		close(t.done)
+	}
+}
+
+// refresh loads every zone. A zone that fails to load keeps the policies from
+// the previous refresh.
+func (t *rpz) refresh() error {
+
+	var errs *multierror.Error
+
+	for _, config := range t.configs {
+
+		z, err := loadRPZZone(config)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("RPZ zone %s failed; error %w", config.GetName(), err))
+			continue
+		}
+
+		zap.L().Debug(fmt.Sprintf("Loaded RPZ zone %s with %d QNAME, %d IP and %d NSDNAME triggers", config.GetName(), len(z.qnames), len(z.ips), len(z.nsdnames)))
+		t.loaded[config.GetName()] = z
+	}
+
+	var zones []*rpzZone
+
+	for _, config := range t.configs {
+		if z := t.loaded[config.GetName()]; z != nil {
+			zones = append(zones, z)
+		}
+	}
+
+	t.mutex.Lock()
+	t.zones = zones
+	t.mutex.Unlock()
+
+	return errs.ErrorOrNil()
+}
+
+func (t *rpz) getZones() []*rpzZone {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.zones
+}
+
+// matchQName returns the policy of the first zone with a QNAME trigger for the
+// name or nil
+func (t *rpz) matchQName(name string) *rpzPolicy {
+
+	for _, z := range t.getZones() {
+		if policy := z.matchQName(name); policy != nil {
+			return policy
+		}
+	}
+
+	return nil
+}
+
+// getNSNames returns the cached NS lookup for the key
+func (t *rpz) getNSNames(key string) ([]string, bool) {
+
+	t.nsMutex.Lock()
+	defer t.nsMutex.Unlock()
+
+	v := t.nsNames[key]
+	if v == nil {
+		return nil, false
+	}
+
+	if time.Now().After(v.expires) {
+		delete(t.nsNames, key)
+		return nil, false
+	}
+
+	return v.names, true
+}
+
+// setNSNames caches the NS lookup for the key
+func (t *rpz) setNSNames(key string, names []string, ttl time.Duration) {
+
+	t.nsMutex.Lock()
+	defer t.nsMutex.Unlock()
+
+	if len(t.nsNames) >= rpzNSCacheSize {
+		t.nsNames = make(map[string]*rpzNSNames)
+	}
+
+	t.nsNames[key] = &rpzNSNames{names: names, expires: time.Now().Add(ttl)}
+}
+
+// loadRPZZone reads the policies from the zone file
+func loadRPZZone(config *RPZZoneConfig) (*rpzZone, error) {
+
+	f, err := os.Open(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	origin := ""
+	if config.Zone != "" {
+		origin = dns.Fqdn(strings.ToLower(config.Zone))
+	}
+
+	z := &rpzZone{
+		name:     config.GetName(),
+		qnames:   make(map[string]*rpzPolicy),
+		nsdnames: make(map[string]*rpzPolicy),
+	}
+
+	var rrs []dns.RR
+
+	zp := dns.NewZoneParser(f, origin, config.Path)
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+
+		if soa, ok := rr.(*dns.SOA); ok && z.soa == nil {
+			z.soa = soa
+			if origin == "" {
+				origin = strings.ToLower(soa.Hdr.Name)
+			}
+			continue
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	if origin == "" {
+		return nil, fmt.Errorf("zone has no origin and no SOA record")
+	}
+
+	// The records of each owner name make up the policy for its trigger
+	var owners []string
+	records := make(map[string][]dns.RR)
+
+	for _, rr := range rrs {
+
+		owner := strings.ToLower(rr.Header().Name)
+
+		// The NS records of the apex are required by the zone format only
+		if owner == origin || !dns.IsSubDomain(origin, owner) {
+			continue
+		}
+
+		if records[owner] == nil {
+			owners = append(owners, owner)
+		}
+		records[owner] = append(records[owner], rr)
+	}
+
+	for _, owner := range owners {
+
+		trigger := owner[:len(owner)-len(origin)]
+
+		policy, err := newRPZPolicy(z, trigger, records[owner])
+		if err != nil {
+			zap.L().Error(fmt.Sprintf("RPZ zone %s trigger %s skipped; error %s", z.name, trigger, err.Error()))
+			continue
+		}
+
+		switch {
+
+		case strings.HasSuffix(trigger, rpzIPSuffix):
+			network, prefix, err := parseRPZIP(strings.TrimSuffix(trigger, rpzIPSuffix))
+			if err != nil {
+				zap.L().Error(fmt.Sprintf("RPZ zone %s trigger %s skipped; error %s", z.name, trigger, err.Error()))
+				continue
+			}
+			z.ips = append(z.ips, &rpzIPPolicy{network: network, prefix: prefix, policy: policy})
+
+		case strings.HasSuffix(trigger, rpzNSDNameSuffix):
+			z.nsdnames[strings.TrimSuffix(trigger, rpzNSDNameSuffix)+"."] = policy
+
+		case strings.HasSuffix(trigger, rpzNSIPSuffix), strings.HasSuffix(trigger, rpzClientIPSuffix):
+			zap.L().Debug(fmt.Sprintf("RPZ zone %s trigger %s is not supported", z.name, trigger))
+
+		default:
+			z.qnames[trigger] = policy
+
+		}
+	}
+
+	return z, nil
+}
+
+// newRPZPolicy returns the policy for the records of a trigger. A CNAME to . is
+// NXDOMAIN, to *. is NODATA, to rpz-passthru. is passthru and to rpz-drop. is
+// drop. Other records are local data that is returned instead of the answer.
+func newRPZPolicy(z *rpzZone, trigger string, rrs []dns.RR) (*rpzPolicy, error) {
+
+	policy := &rpzPolicy{
+		zone:    z,
+		trigger: trigger,
+		action:  rpzRewrite,
+	}
+
+	for _, rr := range rrs {
+
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+
+		switch strings.ToLower(cname.Target) {
+
+		case ".":
+			policy.action = rpzNXDomain
+			return policy, nil
+
+		case "*.":
+			policy.action = rpzNoData
+			return policy, nil
+
+		case "rpz-passthru.":
+			policy.action = rpzPassthru
+			return policy, nil
+
+		case "rpz-drop.":
+			policy.action = rpzDrop
+			return policy, nil
+
+		case "rpz-tcp-only.":
+			return nil, fmt.Errorf("action %s is not supported", cname.Target)
+
+		}
+
+		if len(rrs) > 1 {
+			return nil, fmt.Errorf("CNAME can not be combined with other records")
+		}
+	}
+
+	policy.records = rrs
+
+	return policy, nil
+}
+
+// parseRPZIP returns the network of an IP trigger. The labels are the prefix
+// length followed by the address in reverse order, for IPv6 zz is a run of zero
+// groups. For example 24.0.2.0.192 is 192.0.2.0/24 and 48.zz.db8.2001 is
+// 2001:db8::/48.
+func parseRPZIP(trigger string) (*net.IPNet, int, error) {
+
+	labels := strings.Split(trigger, ".")
+	if len(labels) < 2 {
+		return nil, 0, fmt.Errorf("IP trigger is invalid")
+	}
+
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, 0, fmt.Errorf("IP trigger prefix is invalid")
+	}
+
+	var groups []string
+	for i := len(labels) - 1; i > 0; i-- {
+		groups = append(groups, labels[i])
+	}
+
+	bits := 32
+	ip := net.ParseIP(strings.Join(groups, ".")).To4()
+
+	if ip == nil || len(groups) != 4 {
+
+		bits = 128
+
+		for i, v := range groups {
+			if v == "zz" {
+				groups[i] = ""
+			}
+		}
+
+		address := strings.Join(groups, ":")
+		if strings.HasPrefix(address, ":") {
+			address = ":" + address
+		}
+		if strings.HasSuffix(address, ":") {
+			address = address + ":"
+		}
+
+		ip = net.ParseIP(address)
+		if ip == nil || ip.To4() != nil {
+			return nil, 0, fmt.Errorf("IP trigger address is invalid")
+		}
+	}
+
+	if prefix < 1 || prefix > bits {
+		return nil, 0, fmt.Errorf("IP trigger prefix is invalid")
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, prefix, nil
+}
+
+// matchRPZName returns the policy for the name or the most specific wildcard
+func matchRPZName(policies map[string]*rpzPolicy, name string) *rpzPolicy {
+
+	name = strings.ToLower(name)
+
+	if policy := policies[name]; policy != nil {
+		return policy
+	}
+
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if policy := policies["*."+name[i:]]; policy != nil {
+			return policy
+		}
+	}
+
+	return nil
+}
+
+func (t *rpzZone) matchQName(name string) *rpzPolicy {
+	return matchRPZName(t.qnames, name)
+}
+
+func (t *rpzZone) matchNSDName(name string) *rpzPolicy {
+	return matchRPZName(t.nsdnames, name)
+}
+
+// matchIP returns the policy with the longest prefix that contains the IP
+func (t *rpzZone) matchIP(ip net.IP) *rpzPolicy {
+
+	var match *rpzIPPolicy
+
+	for _, v := range t.ips {
+		if v.network.Contains(ip) && (match == nil || v.prefix > match.prefix) {
+			match = v
+		}
+	}
+
+	if match == nil {
+		return nil
+	}
+
+	return match.policy
+}
+
+// answer returns the local data for the question with the owner set to the
+// name asked for. A CNAME target of *.name is expanded with the name asked for.
+func (t *rpzPolicy) answer(q dns.Question) []dns.RR {
+
+	var rrs []dns.RR
+
+	for _, rr := range t.records {
+
+		cname, isCNAME := rr.(*dns.CNAME)
+
+		if !isCNAME && q.Qtype != dns.TypeANY && rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+
+		if isCNAME && strings.HasPrefix(cname.Target, "*.") {
+			rr.(*dns.CNAME).Target = strings.TrimSuffix(q.Name, ".") + cname.Target[1:]
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+// serveRPZ answers the request according to the policy zones. A QNAME trigger
+// is applied before the request is answered, the other triggers and QNAME
+// triggers for CNAME targets are applied to the answer by rpzWriter.
+func (t *Server) serveRPZ(w dns.ResponseWriter, r *dns.Msg) {
+
+	policy := t.rpz.matchQName(r.Question[0].Name)
+
+	if policy == nil {
+		t.mux.ServeDNS(&rpzWriter{ResponseWriter: w, server: t, group: t.getClientGroup(w.RemoteAddr()), req: r}, r)
+		return
+	}
+
+	if policy.action == rpzPassthru {
+		t.mux.ServeDNS(w, r)
+		return
+	}
+
+	t.writePolicy(w, r, policy)
+}
+
+// rpzWriter applies the policy zones to the answer before it is written
+type rpzWriter struct {
+	dns.ResponseWriter
+	server *Server
+	group  *clientGroup
+	req    *dns.Msg
+}
+
+func (t *rpzWriter) WriteMsg(m *dns.Msg) error {
+
+	policy := t.server.matchRPZAnswer(t.group, t.req, m)
+	if policy == nil || policy.action == rpzPassthru {
+		return t.ResponseWriter.WriteMsg(m)
+	}
+
+	return t.server.writePolicy(t.ResponseWriter, t.req, policy)
+}
+
+// matchRPZAnswer returns the policy of the first zone with a trigger for the
+// answer or nil. Within a zone QNAME triggers for CNAME targets take precedence
+// over IP triggers which take precedence over NSDNAME triggers.
+func (t *Server) matchRPZAnswer(g *clientGroup, r, m *dns.Msg) *rpzPolicy {
+
+	var nsNames []string
+	nsResolved := false
+
+	for _, z := range t.rpz.getZones() {
+
+		for _, rr := range m.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				if policy := z.matchQName(cname.Target); policy != nil {
+					return policy
+				}
+			}
+		}
+
+		for _, rr := range m.Answer {
+			var ip net.IP
+			switch v := rr.(type) {
+			case *dns.A:
+				ip = v.A
+			case *dns.AAAA:
+				ip = v.AAAA
+			default:
+				continue
+			}
+			if policy := z.matchIP(ip); policy != nil {
+				return policy
+			}
+		}
+
+		if len(z.nsdnames) <= 0 {
+			continue
+		}
+
+		if !nsResolved {
+			nsNames = t.getNSNames(g, r.Question[0].Name)
+			nsResolved = true
+		}
+
+		for _, name := range nsNames {
+			if policy := z.matchNSDName(name); policy != nil {
+				return policy
+			}
+		}
+	}
+
+	return nil
+}
+
+// getNSNames returns the names of the nameservers that are authoritative for
+// the name. For names that are not local the closest NS records are looked up
+// through the nameservers of the client group and cached.
+func (t *Server) getNSNames(g *clientGroup, name string) []string {
+
+	var names []string
+
+	if t.isLocal(name) {
+		for _, rr := range t.getZone(name).getNS() {
+			names = append(names, strings.ToLower(rr.(*dns.NS).Ns))
+		}
+		return names
+	}
+
+	if t.getClientForwarder(g, name) == nil {
+		return nil
+	}
+
+	name = dns.Fqdn(strings.ToLower(name))
+
+	key := name
+	if g != nil {
+		key = g.name + "/" + name
+	}
+
+	if names, ok := t.rpz.getNSNames(key); ok {
+		return names
+	}
+
+	names, ttl, err := t.lookupNSNames(g, name)
+	if err != nil {
+		if logger.Trace {
+			zap.L().Debug(fmt.Sprintf("NS lookup for %s failed; error %s", name, err.Error()))
+		}
+		return nil
+	}
+
+	t.rpz.setNSNames(key, names, ttl)
+
+	return names
+}
+
+// lookupNSNames returns the names of the closest NS records for the name and
+// how long they can be cached
+func (t *Server) lookupNSNames(g *clientGroup, name string) ([]string, time.Duration, error) {
+
+	for name != "" {
+
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeNS)
+
+		resp, err := t.exchange(g, req)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var names []string
+		ttl := rpzNSMaxTTL
+
+		for _, rr := range resp.Answer {
+			if ns, ok := rr.(*dns.NS); ok {
+				names = append(names, strings.ToLower(ns.Ns))
+				if v := time.Duration(ns.Hdr.Ttl) * time.Second; v < ttl {
+					ttl = v
+				}
+			}
+		}
+
+		if len(names) > 0 {
+			return names, ttl, nil
+		}
+
+		// A negative answer has the SOA of the zone that the name is in
+		parent := ""
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				parent = strings.ToLower(soa.Hdr.Name)
+			}
+		}
+
+		if parent == "" || parent == name || !dns.IsSubDomain(parent, name) {
+			i, end := dns.NextLabel(name, 0)
+			if end {
+				break
+			}
+			parent = name[i:]
+		}
+
+		name = parent
+	}
+
+	return nil, rpzNSNegativeTTL, nil
+}
+
+// writePolicy writes the answer for the policy. The SOA of the policy zone is
+// added to the additional section so the policy that was applied can be found.
+func (t *Server) writePolicy(w dns.ResponseWriter, r *dns.Msg, policy *rpzPolicy) error {
+
+	q := r.Question[0]
+
+	if logger.Trace {
+		zap.L().Debug(fmt.Sprintf("%s matched RPZ zone %s trigger %s", q.Name, policy.zone.name, policy.trigger))
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	switch policy.action {
+
+	case rpzDrop:
+		return nil
+
+	case rpzNXDomain:
+		m.Rcode = dns.RcodeNameError
+
+	case rpzRewrite:
+		m.Answer = policy.answer(q)
+
+		// A CNAME is followed unless it was asked for
+		if len(m.Answer) == 1 && q.Qtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+			if cname, ok := m.Answer[0].(*dns.CNAME); ok {
+				resp := t.resolve(w, cname.Target, q.Qtype)
+				if resp != nil {
+					m.Answer = append(m.Answer, resp.Answer...)
+					m.Rcode = resp.Rcode
+				}
+			}
+		}
+
+	}
+
+	if policy.zone.soa != nil {
+		m.Extra = append(m.Extra, dns.Copy(policy.zone.soa))
+	}
+
+	return w.WriteMsg(m)
+}
+
+// resolve returns the answer for the name from the local records or the
+// nameservers without applying the policy zones or nil
+func (t *Server) resolve(w dns.ResponseWriter, name string, qtype uint16) *dns.Msg {
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+
+	rw := &responseWriter{
+		localAddr:  w.LocalAddr(),
+		remoteAddr: w.RemoteAddr(),
+	}
+
+	t.mux.ServeDNS(rw, req)
+
+	return rw.msg
+}
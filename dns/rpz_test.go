@@ -0,0 +1,384 @@
+package dns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testRPZZone is a policy zone with a trigger for each action
+var testRPZZone = []string{
+	"$TTL 60",
+	"@ SOA localhost. root.localhost. 1 3600 600 86400 60",
+	"@ NS localhost.",
+	"blocked.example.com CNAME .",
+	"*.wild.example.com CNAME .",
+	"ok.wild.example.com CNAME rpz-passthru.",
+	"nodata.example.com CNAME *.",
+	"drop.example.com CNAME rpz-drop.",
+	"rewrite.example.com A 192.0.2.10",
+	"rewrite.example.com TXT rewritten",
+	"walled.example.com CNAME garden.example.net.",
+	"*.expand.example.com CNAME *.garden.example.net.",
+	"target.example.net CNAME .",
+	"32.9.113.0.203.rpz-ip CNAME .",
+	"ns1.evil.example.rpz-nsdname CNAME .",
+	"tcp.example.com CNAME rpz-tcp-only.",
+	"32.1.2.3.rpz-ip CNAME .",
+}
+
+// testRPZNameserver returns a handler that answers as the nameservers of the
+// policy zone tests. NS queries for evil.example.org are answered with
+// ns1.evil.example and counted.
+func testRPZNameserver(nsQueries *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+
+		q := r.Question[0]
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		rr := func(s string) {
+			v, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, v)
+		}
+
+		switch {
+
+		case q.Qtype == dns.TypeNS && q.Name == "evil.example.org.":
+			nsQueries.Add(1)
+			rr("evil.example.org. 60 NS ns1.evil.example.")
+
+		case q.Qtype == dns.TypeNS && dns.IsSubDomain("evil.example.org.", q.Name):
+			nsQueries.Add(1)
+			soa, _ := dns.NewRR("evil.example.org. 60 SOA ns1.evil.example. root.evil.example. 1 3600 600 86400 60")
+			m.Ns = append(m.Ns, soa)
+
+		case q.Qtype == dns.TypeNS:
+
+		case q.Name == "badip.example.com.":
+			rr("badip.example.com. 60 A 203.0.113.9")
+
+		case q.Name == "cname.example.com.":
+			rr("cname.example.com. 60 CNAME target.example.net.")
+			rr("target.example.net. 60 A 203.0.113.1")
+
+		default:
+			testAnswer("203.0.113.1")(w, r)
+			return
+
+		}
+
+		w.WriteMsg(m)
+	}
+}
+
+func testRPZConfig(t *testing.T, nameservers ...*NetPort) *Config {
+
+	config := &Config{
+		Nameservers: nameservers,
+		RPZ:         &RPZConfig{Enabled: true},
+	}
+
+	config.RPZ.AddZones(&RPZZoneConfig{
+		Name:    "test",
+		Enabled: true,
+		Zone:    "rpz.example",
+		Path:    testFile(t, "rpz.zone", testRPZZone...),
+	})
+
+	return config
+}
+
+func TestParseRPZIP(t *testing.T) {
+
+	tests := []struct {
+		trigger string
+		network string
+	}{
+		{"32.1.2.0.192", "192.0.2.1/32"},
+		{"24.0.2.0.192", "192.0.2.0/24"},
+		{"24.9.2.0.192", "192.0.2.0/24"},
+		{"128.1.zz.db8.2001", "2001:db8::1/128"},
+		{"48.zz.db8.2001", "2001:db8::/48"},
+		{"128.1.zz", "::1/128"},
+		{"33.0.2.0.192", ""},
+		{"0.0.2.0.192", ""},
+		{"x.0.2.0.192", ""},
+		{"24.2.0.192", ""},
+		{"24", ""},
+		{"64.zz.x.2001", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.trigger, func(t *testing.T) {
+
+			network, prefix, err := parseRPZIP(test.trigger)
+
+			if test.network == "" {
+				if err == nil {
+					t.Fatalf("expected error, got %s", network)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if network.String() != test.network {
+				t.Fatalf("expected %s, got %s", test.network, network)
+			}
+
+			if ones, _ := network.Mask.Size(); ones != prefix {
+				t.Fatalf("expected prefix %d, got %d", ones, prefix)
+			}
+		})
+	}
+}
+
+func TestLoadRPZZone(t *testing.T) {
+
+	z, err := loadRPZZone(&RPZZoneConfig{
+		Name: "test",
+		Zone: "rpz.example",
+		Path: testFile(t, "rpz.zone", testRPZZone...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if z.soa == nil {
+		t.Fatal("expected SOA")
+	}
+
+	// The unsupported action and the invalid IP trigger are skipped
+	if len(z.qnames) != 9 || len(z.ips) != 1 || len(z.nsdnames) != 1 {
+		t.Fatalf("expected 9 QNAME, 1 IP and 1 NSDNAME triggers, got %d, %d and %d", len(z.qnames), len(z.ips), len(z.nsdnames))
+	}
+
+	tests := []struct {
+		name   string
+		action rpzAction
+	}{
+		{"blocked.example.com.", rpzNXDomain},
+		{"Blocked.Example.COM.", rpzNXDomain},
+		{"a.wild.example.com.", rpzNXDomain},
+		{"a.b.wild.example.com.", rpzNXDomain},
+		{"ok.wild.example.com.", rpzPassthru},
+		{"nodata.example.com.", rpzNoData},
+		{"drop.example.com.", rpzDrop},
+		{"rewrite.example.com.", rpzRewrite},
+	}
+
+	for _, test := range tests {
+		policy := z.matchQName(test.name)
+		if policy == nil {
+			t.Fatalf("expected %s to match", test.name)
+		}
+		if policy.action != test.action {
+			t.Fatalf("expected %s action %d, got %d", test.name, test.action, policy.action)
+		}
+	}
+
+	for _, name := range []string{"wild.example.com.", "example.com.", "tcp.example.com."} {
+		if z.matchQName(name) != nil {
+			t.Fatalf("unexpected match for %s", name)
+		}
+	}
+
+	if z.matchIP(net.ParseIP("203.0.113.9")) == nil || z.matchIP(net.ParseIP("203.0.113.1")) != nil {
+		t.Fatal("expected IP trigger to match 203.0.113.9 only")
+	}
+
+	if z.matchNSDName("ns1.evil.example.") == nil || z.matchNSDName("ns2.evil.example.") != nil {
+		t.Fatal("expected NSDNAME trigger to match ns1.evil.example only")
+	}
+}
+
+func TestLoadRPZZoneOrigin(t *testing.T) {
+
+	// Without a zone name the origin is the owner of the SOA
+	z, err := loadRPZZone(&RPZZoneConfig{
+		Name: "test",
+		Path: testFile(t, "rpz.zone",
+			"rpz.example. 60 SOA localhost. root.localhost. 1 3600 600 86400 60",
+			"blocked.example.com.rpz.example. 60 CNAME .",
+		),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if z.matchQName("blocked.example.com.") == nil {
+		t.Fatal("expected trigger relative to the SOA owner")
+	}
+
+	_, err = loadRPZZone(&RPZZoneConfig{
+		Name: "test",
+		Path: testFile(t, "rpz.zone", "blocked.example.com. 60 CNAME ."),
+	})
+	if err == nil {
+		t.Fatal("expected error for zone without origin")
+	}
+}
+
+func TestRPZServer(t *testing.T) {
+
+	var nsQueries atomic.Int32
+
+	s := testServer(t, testRPZConfig(t, testNameserver(t, testRPZNameserver(&nsQueries))))
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers []string
+		policy  bool
+	}{
+		{"QNAME", "blocked.example.com.", dns.TypeA, dns.RcodeNameError, nil, true},
+		{"wildcard", "a.wild.example.com.", dns.TypeA, dns.RcodeNameError, nil, true},
+		{"wildcard does not match its parent", "wild.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"203.0.113.1"}, false},
+		{"passthru", "ok.wild.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"203.0.113.1"}, false},
+		{"NODATA", "nodata.example.com.", dns.TypeA, dns.RcodeSuccess, nil, true},
+		{"rewrite", "rewrite.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.10"}, true},
+		{"rewrite other type", "rewrite.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{"rewritten"}, true},
+		{"rewrite without the type", "rewrite.example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil, true},
+		{"rewrite CNAME is followed", "walled.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"garden.example.net.", "203.0.113.1"}, true},
+		{"rewrite CNAME is not followed for CNAME", "walled.example.com.", dns.TypeCNAME, dns.RcodeSuccess, []string{"garden.example.net."}, true},
+		{"rewrite wildcard CNAME", "a.expand.example.com.", dns.TypeCNAME, dns.RcodeSuccess, []string{"a.expand.example.com.garden.example.net."}, true},
+		{"CNAME target", "cname.example.com.", dns.TypeA, dns.RcodeNameError, nil, true},
+		{"answer IP", "badip.example.com.", dns.TypeA, dns.RcodeNameError, nil, true},
+		{"NSDNAME", "evil.example.org.", dns.TypeA, dns.RcodeNameError, nil, true},
+		{"NSDNAME of parent zone", "host.evil.example.org.", dns.TypeA, dns.RcodeNameError, nil, true},
+		{"not matched", "www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"203.0.113.1"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			resp := testQuery(t, s, "192.168.1.50", test.qname, test.qtype)
+
+			if resp.Rcode != test.rcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[test.rcode], dns.RcodeToString[resp.Rcode])
+			}
+
+			if len(resp.Answer) != len(test.answers) {
+				t.Fatalf("expected %d answers, got %v", len(test.answers), resp.Answer)
+			}
+
+			for i, answer := range test.answers {
+				if v := testAnswerValue(&dns.Msg{Answer: resp.Answer[i:]}); v != answer {
+					t.Fatalf("expected answer %q, got %q", answer, v)
+				}
+				if i == 0 && resp.Answer[0].Header().Name != test.qname {
+					t.Fatalf("expected answer for %s, got %s", test.qname, resp.Answer[0].Header().Name)
+				}
+			}
+
+			// The SOA of the policy zone shows which policy was applied
+			policy := len(resp.Extra) > 0 && resp.Extra[0].Header().Name == "rpz.example."
+			if policy != test.policy {
+				t.Fatalf("expected policy %v, got %v", test.policy, policy)
+			}
+		})
+	}
+}
+
+func TestRPZDrop(t *testing.T) {
+
+	s := testServer(t, testRPZConfig(t, testNameserver(t, testAnswer("203.0.113.1"))))
+
+	r := new(dns.Msg)
+	r.SetQuestion("drop.example.com.", dns.TypeA)
+
+	if _, err := s.Query(r, testLocalAddr, &net.UDPAddr{IP: net.ParseIP("192.168.1.50"), Port: 5353}); err == nil {
+		t.Fatal("expected no response")
+	}
+}
+
+func TestRPZNSNamesCached(t *testing.T) {
+
+	var nsQueries atomic.Int32
+
+	s := testServer(t, testRPZConfig(t, testNameserver(t, testRPZNameserver(&nsQueries))))
+
+	for i := 0; i < 3; i++ {
+		if resp := testQuery(t, s, "192.168.1.50", "host.evil.example.org.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("expected NXDOMAIN, got %s", dns.RcodeToString[resp.Rcode])
+		}
+	}
+
+	// host.evil.example.org has no NS records so its zone is looked up too
+	if nsQueries.Load() != 2 {
+		t.Fatalf("expected 2 NS lookups, got %d", nsQueries.Load())
+	}
+
+	// Expired lookups are repeated
+	key := "host.evil.example.org."
+	s.rpz.setNSNames(key, []string{"ns1.evil.example."}, -time.Second)
+
+	testQuery(t, s, "192.168.1.50", key, dns.TypeA)
+
+	if nsQueries.Load() != 4 {
+		t.Fatalf("expected expired NS lookup to be repeated, got %d", nsQueries.Load())
+	}
+}
+
+func TestRPZNSNamesGroup(t *testing.T) {
+
+	var nsQueries atomic.Int32
+
+	// Only the nameserver of the group knows the NS records of evil.example.org
+	global := testNameserver(t, testAnswer("203.0.113.1"))
+	group := testNameserver(t, testRPZNameserver(&nsQueries))
+
+	config := testRPZConfig(t, global)
+	config.ClientGroups = append(config.ClientGroups, &ClientGroupConfig{
+		Name:        "kids",
+		CIDRs:       []string{"192.168.2.0/24"},
+		Nameservers: []*NetPort{group},
+	})
+
+	s := testServer(t, config)
+
+	if resp := testQuery(t, s, "192.168.1.50", "evil.example.org.", dns.TypeA); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR outside the group, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if resp := testQuery(t, s, "192.168.2.50", "evil.example.org.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN in the group, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if nsQueries.Load() != 1 {
+		t.Fatalf("expected NS lookup through the group nameservers, got %d", nsQueries.Load())
+	}
+}
+
+func TestRPZShutdown(t *testing.T) {
+
+	config := testRPZConfig(t)
+	config.RPZ.Refresh = time.Hour
+
+	r := newRPZ(config.RPZ)
+	if err := r.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		r.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected shutdown to return")
+	}
+}
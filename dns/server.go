@@ -2,26 +2,63 @@ package dns
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/hashicorp/go-multierror"
 	logger "github.com/jodydadescott/jody-go-logger"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 
 	"github.com/jodydadescott/home-dns-server/types"
 	"github.com/jodydadescott/home-dns-server/types/proto"
+	"github.com/jodydadescott/home-dns-server/util"
+)
+
+const (
+	maxCNameDepth = 8
 )
 
 type Server struct {
+	mux          *dns.ServeMux
+	origin       string
 	listeners    []*NetPort
-	domainNames  []string
-	udpDnsClient *dns.Client
-	tcpDnsClient *dns.Client
+	zones        []*zone
+	zoneMutex    sync.RWMutex
+	reverseZones []string
+	soa          *SOAConfig
 	clients      []*Client
-	nameservers  []*NetPort
+	forwarders   []*forwarder
+	roundRobin   bool
+	rotation     uint32
+	ttl          time.Duration
+	fallthroughs []string
+	cache        *cache
+	blocklist    *blocklist
+	rpz          *rpz
+	clientGroups []*clientGroup
+	views        []*view
+	access       *access
+
+	// listenerAccess is the access control of the listeners that have one
+	listenerAccess map[*NetPort]*access
+
+	// ednsBufferSize is the UDP payload size advertised to clients and nameservers
+	ednsBufferSize uint16
+
+	// publicReverseZones derives reverse zones from PTR records with public IPv4 addresses
+	publicReverseZones bool
+
+	// fallthroughTypes are the query types that fall through, all if empty
+	fallthroughTypes map[uint16]bool
+
+	// shutdownTimeout is how long in flight queries are given to complete on shutdown
+	shutdownTimeout time.Duration
 }
 
 func New(config *Config) *Server {
@@ -41,6 +78,15 @@ func New(config *Config) *Server {
 
 			case proto.UDP, proto.TCP:
 
+			case proto.TLS:
+				if listener.CertFile == "" || listener.KeyFile == "" {
+					panic("CertFile and KeyFile are required for TLS listener")
+				}
+
+				if listener.Port <= 0 {
+					listener.Port = types.DefaultDoTPort
+				}
+
 			case proto.Empty:
 				listener.Proto = proto.UDP
 
@@ -54,32 +100,112 @@ func New(config *Config) *Server {
 		}
 	}
 
-	var nameservers []*NetPort
-	for _, nameserver := range config.Nameservers {
+	c := &Server{
+		mux:          dns.NewServeMux(),
+		origin:       types.DefaultDomain,
+		listeners:    config.Listeners,
+		soa:          config.SOA,
+		roundRobin:   config.RoundRobin,
+		ttl:          config.TTL,
+		fallthroughs: config.Fallthrough,
+		reverseZones: config.ReverseZones,
+
+		shutdownTimeout:    config.ShutdownTimeout,
+		ednsBufferSize:     config.EDNSBufferSize,
+		publicReverseZones: config.PublicReverseZones,
+	}
 
-		switch nameserver.Proto {
+	c.access = newAccess(config.Access)
 
-		case proto.UDP, proto.TCP:
+	for _, listener := range c.listeners {
+		if listener.Access != nil {
+			if c.listenerAccess == nil {
+				c.listenerAccess = make(map[*NetPort]*access)
+			}
+			c.listenerAccess[listener] = newAccess(listener.Access)
+		}
+	}
 
-		case proto.Empty:
-			nameserver.Proto = proto.UDP
+	for _, v := range config.FallthroughTypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(v)]
+		if !ok {
+			panic(fmt.Sprintf("fallthrough type %s is invalid", v))
+		}
+		if c.fallthroughTypes == nil {
+			c.fallthroughTypes = make(map[uint16]bool)
+		}
+		c.fallthroughTypes[qtype] = true
+	}
+
+	if c.shutdownTimeout <= 0 {
+		c.shutdownTimeout = types.DefaultShutdownTimeout
+	}
+
+	if c.ttl <= 0 {
+		c.ttl = types.DefaultTTL
+	}
+
+	if c.ednsBufferSize < dns.MinMsgSize {
+		c.ednsBufferSize = types.DefaultEDNSBufferSize
+	}
+
+	if len(config.Nameservers) > 0 {
+		c.forwarders = append(c.forwarders, newForwarder(".", config.Nameservers, config.Upstream))
+	}
 
-		default:
-			panic("Proto Invalid")
+	for _, forwarderConfig := range config.Forwarders {
+
+		if forwarderConfig == nil {
+			panic("nil forwarder")
+		}
+
+		if forwarderConfig.Domain == "" {
+			panic("forwarder requires a domain")
 		}
 
-		if nameserver.Port <= 0 {
-			nameserver.Port = types.DefaultDnsPort
+		upstream := forwarderConfig.Upstream
+		if upstream == nil {
+			upstream = config.Upstream
 		}
 
-		nameservers = append(nameservers, nameserver)
+		f := newForwarder(forwarderConfig.Domain, forwarderConfig.Nameservers, upstream)
+
+		for _, existing := range c.forwarders {
+			if existing.name == f.name {
+				panic(fmt.Sprintf("forwarder %s is defined more than once", f.name))
+			}
+		}
+
+		c.forwarders = append(c.forwarders, f)
 	}
 
-	c := &Server{
-		listeners:    config.Listeners,
-		udpDnsClient: &dns.Client{Net: "udp", SingleInflight: true},
-		tcpDnsClient: &dns.Client{Net: "tcp", SingleInflight: true},
-		nameservers:  nameservers,
+	if config.Cache != nil && config.Cache.Enabled {
+		c.cache = newCache(config.Cache)
+	}
+
+	if config.Blocklist != nil && config.Blocklist.Enabled {
+		c.blocklist = newBlocklist(config.Blocklist)
+	}
+
+	if config.RPZ != nil && config.RPZ.Enabled {
+		c.rpz = newRPZ(config.RPZ)
+	}
+
+	for _, groupConfig := range config.ClientGroups {
+
+		if groupConfig == nil {
+			panic("nil client group")
+		}
+
+		g := newClientGroup(groupConfig, config.Upstream, config.Cache)
+
+		for _, existing := range c.clientGroups {
+			if existing.name == g.name {
+				panic(fmt.Sprintf("client group %s is defined more than once", g.name))
+			}
+		}
+
+		c.clientGroups = append(c.clientGroups, g)
 	}
 
 	for _, provider := range config.Providers {
@@ -89,6 +215,24 @@ func New(config *Config) *Server {
 		c.clients = append(c.clients, newClient(provider))
 	}
 
+	// Relative SOA names of reverse zones are qualified with the first domain
+	if len(c.clients) > 0 {
+		c.origin = c.clients[0].GetDomainName()
+	}
+
+	for _, viewConfig := range config.Views {
+
+		v := newView(c, viewConfig)
+
+		for _, existing := range c.views {
+			if existing.name == v.name {
+				panic(fmt.Sprintf("view %s is defined more than once", v.name))
+			}
+		}
+
+		c.views = append(c.views, v)
+	}
+
 	return c
 }
 
@@ -97,308 +241,433 @@ func (t *Server) GetRecords() *DomainRecords {
 	records := &DomainRecords{}
 
 	for _, client := range t.clients {
-		records.ARecords = append(records.ARecords, client.getARecords()...)
-		records.AAAARecords = append(records.AAAARecords, client.getAAAARecords()...)
+		records.ARecords = append(records.ARecords, client.getAllARecords()...)
+		records.AAAARecords = append(records.AAAARecords, client.getAllAAAARecords()...)
 	}
 
 	return records
 }
 
-func (t *Server) Run(ctx context.Context) error {
-
-	getARecord := func(name string) *ARecord {
-
-		name = strings.ToLower(name)
-
-		for _, client := range t.clients {
-			r := client.getARecord(name)
-			if r != nil {
-				return r
-			}
-		}
+// GetCacheStats returns the counters for the cache of forwarded responses or
+// nil if the cache is not enabled
+func (t *Server) GetCacheStats() *CacheStats {
+	if t.cache == nil {
 		return nil
 	}
+	return t.cache.getStats()
+}
 
-	getAAAARecord := func(name string) *ARecord {
+// getZone returns the most specific locally served zone for the name or nil
+func (t *Server) getZone(name string) *zone {
 
-		name = strings.ToLower(name)
+	name = strings.ToLower(name)
 
-		for _, client := range t.clients {
-			r := client.getAAAARecord(name)
-			if r != nil {
-				return r
-			}
-		}
-		return nil
-	}
+	t.zoneMutex.RLock()
+	defer t.zoneMutex.RUnlock()
 
-	getPTRRecord := func(name string) *PTRrecord {
+	var match *zone
 
-		name = strings.ToLower(name)
-
-		for _, client := range t.clients {
-			r := client.getPTRRecord(name)
-			if r != nil {
-				return r
+	for _, z := range t.zones {
+		if dns.IsSubDomain(z.name, name) {
+			if match == nil || len(z.name) > len(match.name) {
+				match = z
 			}
 		}
-		return nil
 	}
 
-	getCNameRecord := func(name string) *CNameRecord {
+	return match
+}
+
+// getForwarder returns the most specific forwarder for the name or nil
+func (t *Server) getForwarder(name string) *forwarder {
+
+	name = strings.ToLower(name)
 
-		name = strings.ToLower(name)
+	var match *forwarder
 
-		for _, client := range t.clients {
-			r := client.getCNameRecord(name)
-			if r != nil {
-				return r
+	for _, f := range t.forwarders {
+		if dns.IsSubDomain(f.name, name) {
+			if match == nil || len(f.name) > len(match.name) {
+				match = f
 			}
 		}
-		return nil
 	}
 
-	handleRemote := func(w dns.ResponseWriter, r *dns.Msg) {
+	return match
+}
 
-		dnsClient := t.tcpDnsClient
+// fallsThrough returns true if a query of the type without a local answer in
+// the zone is forwarded
+func (t *Server) fallsThrough(z *zone, qtype uint16) bool {
 
-		for _, nameserver := range t.nameservers {
+	if z == nil || !z.fallThrough {
+		return false
+	}
 
-			switch nameserver.Proto {
+	return len(t.fallthroughTypes) <= 0 || t.fallthroughTypes[qtype]
+}
 
-			case proto.TCP:
-				dnsClient = t.tcpDnsClient
+// isLocal returns true if the name is in a locally served zone and there is
+// no conditional forwarder for a more specific domain
+func (t *Server) isLocal(name string) bool {
 
-			case proto.UDP:
-				dnsClient = t.udpDnsClient
+	z := t.getZone(name)
+	if z == nil {
+		return false
+	}
 
-			}
+	if f := t.getForwarder(name); f != nil && len(f.name) >= len(z.name) {
+		return false
+	}
 
-			r, _, err := dnsClient.Exchange(r, nameserver.GetIPColonPort())
+	return true
+}
 
-			if err == nil {
-				rString, _ := json.Marshal(r)
+// addZone adds the zone with the name and registers it to be handled locally if
+// it does not exist. The clients are added to the zone.
+func (t *Server) addZone(name, origin string, clients ...*Client) {
 
-				if r.Rcode == dns.RcodeSuccess {
-					r.Compress = true
-					w.WriteMsg(r)
+	name = dns.Fqdn(strings.ToLower(name))
 
-					if logger.Trace {
-						zap.L().Debug(fmt.Sprintf("Remote Nameserver %s responded with %s", nameserver.GetIPColonPort(), rString))
-					}
+	t.zoneMutex.Lock()
+	defer t.zoneMutex.Unlock()
 
-					return
-				}
-			} else {
-				if logger.Trace {
-					zap.L().Debug(fmt.Sprintf("Remote Nameserver %s responded with error %s", nameserver.GetIPColonPort(), err.Error()))
-				}
+	for _, z := range t.zones {
+		if z.name == name {
+			for _, client := range clients {
+				z.addClient(client)
 			}
+			return
 		}
+	}
 
-		if logger.Trace {
-			zap.L().Debug("failure to forward request")
-		}
+	z := newZone(name, origin, t.soa, t.ttl)
 
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.SetRcode(r, dns.RcodeServerFailure)
-		w.WriteMsg(m)
+	for _, client := range clients {
+		z.addClient(client)
 	}
 
-	handleLocal := func(w dns.ResponseWriter, r *dns.Msg) {
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Compress = false
+	for _, v := range t.fallthroughs {
+		if dns.Fqdn(strings.ToLower(v)) == name {
+			z.fallThrough = true
+		}
+	}
 
-		// local := false
+	t.zones = append(t.zones, z)
 
-		switch r.Opcode {
-		case dns.OpcodeQuery:
+	// A conditional forwarder for the same domain takes precedence as it does
+	// in isLocal so its registration is kept
+	if f := t.getForwarder(z.name); f != nil && len(f.name) >= len(z.name) {
+		zap.L().Debug(fmt.Sprintf("Adding zone %s; it is forwarded to %s", z.name, f.name))
+		return
+	}
 
-			for _, q := range m.Question {
+	zap.L().Debug(fmt.Sprintf("Adding zone %s to be handled locally", z.name))
+	t.mux.HandleFunc(z.name, t.handleLocal)
+}
 
-				switch q.Qtype {
+// syncReverseZones adds the configured reverse zones and the reverse zones of
+// the PTR records in locally served IPv4 ranges and in IPv6. It is called after each refresh so
+// that new prefixes are served locally.
+func (t *Server) syncReverseZones() {
 
-				case dns.TypeA:
-					lookup := getARecord(q.Name)
-					if lookup != nil {
-						record := fmt.Sprintf("%s A %s", q.Name, lookup.GetValue())
+	names := make(map[string]bool)
+
+	for _, cidr := range t.reverseZones {
+		zoneNames, err := util.GetReverseZones(cidr)
+		if err != nil {
+			zap.L().Error(fmt.Sprintf("Reverse zone %s is invalid; error %s", cidr, err.Error()))
+			continue
+		}
+		for _, name := range zoneNames {
+			names[name] = true
+		}
+	}
 
-						if logger.Trace {
-							zap.L().Debug(fmt.Sprintf("success -> %s, source=%s", record, lookup.SRC))
-						}
+	for _, client := range t.clients {
+		for _, key := range client.getPTRKeys() {
+
+			// Public IPv4 ranges are shared with hosts we do not know about so
+			// their zones are only derived if asked for. An IPv6 /64 is the
+			// prefix of a single network so it is always derived.
+			if !t.publicReverseZones && !strings.HasSuffix(strings.TrimSuffix(key, "."), util.IP6arpa) {
+				local, err := util.IsLocallyServed(key)
+				if err == nil && !local {
+					continue
+				}
+			}
 
-						rr, err := dns.NewRR(record)
+			name, err := util.GetReverseZone(key)
+			if err != nil {
+				zap.L().Debug(fmt.Sprintf("PTR %s has no reverse zone; error %s", key, err.Error()))
+				continue
+			}
+			names[name] = true
+		}
+	}
 
-						if err == nil {
-							m.Answer = append(m.Answer, rr)
-						} else {
-							zap.L().Error(err.Error())
-						}
+	for name := range names {
+		t.addZone(name, t.origin, t.clients...)
+	}
+}
 
-						// local = true
+// AddZone adds a zone that is answered from the records of the providers. The
+// providers with a matching domain name provide the NS records and the serial,
+// if there are none all providers are used. Adding an existing zone has no effect.
+func (t *Server) AddZone(name string) {
 
-					} else {
-						if logger.Trace {
-							zap.L().Debug(fmt.Sprintf("fail -> %s has no A record", q.Name))
-						}
-					}
+	var clients []*Client
 
-				case dns.TypeAAAA:
-					lookup := getAAAARecord(q.Name)
-					if lookup != nil {
-						record := fmt.Sprintf("%s AAAA %s", q.Name, lookup.GetValue())
+	for _, client := range t.clients {
+		if dns.Fqdn(strings.ToLower(client.GetDomainName())) == dns.Fqdn(strings.ToLower(name)) {
+			clients = append(clients, client)
+		}
+	}
 
-						if logger.Trace {
-							zap.L().Debug(fmt.Sprintf("success -> %s, source=%s", record, lookup.SRC))
-						}
+	if len(clients) <= 0 {
+		clients = t.clients
+	}
 
-						rr, err := dns.NewRR(record)
+	t.addZone(name, t.origin, clients...)
+}
 
-						if err == nil {
-							m.Answer = append(m.Answer, rr)
-						} else {
-							zap.L().Error(err.Error())
-						}
+// RemoveZone stops handling the zone locally. Queries for the zone will be
+// forwarded if forwarding is enabled. A reverse zone that is derived from PTR
+// records is added again on the next refresh.
+func (t *Server) RemoveZone(name string) {
 
-						// local = true
+	name = dns.Fqdn(strings.ToLower(name))
 
-					} else {
-						if logger.Trace {
-							zap.L().Debug(fmt.Sprintf("fail -> %s has no AAAA record", q.Name))
-						}
-					}
+	t.zoneMutex.Lock()
+	defer t.zoneMutex.Unlock()
 
-				case dns.TypePTR:
-					lookup := getPTRRecord(q.Name)
-					if lookup != nil {
-						record := fmt.Sprintf("%s PTR %s", q.Name, lookup.GetValue())
+	for i, z := range t.zones {
+		if z.name == name {
+			zap.L().Debug(fmt.Sprintf("Removing zone %s", z.name))
+			t.zones = append(t.zones[:i], t.zones[i+1:]...)
+			if f := t.getForwarder(name); f != nil && len(f.name) >= len(name) {
+				return
+			}
+			t.mux.HandleRemove(name)
+			return
+		}
+	}
+}
 
-						if logger.Trace {
-							zap.L().Debug(fmt.Sprintf("success -> %s, source=%s", record, lookup.SRC))
-						}
+// handleForwarders registers the domains of the forwarders to be forwarded.
+// Without global nameservers the root is forwarded if a client group has its
+// own nameservers.
+func (t *Server) handleForwarders() {
 
-						rr, err := dns.NewRR(record)
+	for _, f := range t.forwarders {
+		t.mux.HandleFunc(f.name, t.handleRemote)
+	}
 
-						if err == nil {
-							m.Answer = append(m.Answer, rr)
-						} else {
-							zap.L().Error(err.Error())
-						}
+	if t.getForwarder(".") != nil {
+		return
+	}
 
-						//	local = true
+	for _, g := range t.clientGroups {
+		if g.forwarder != nil {
+			t.mux.HandleFunc(".", t.handleRemote)
+			return
+		}
+	}
+}
 
-					} else {
-						if logger.Trace {
-							zap.L().Debug((fmt.Sprintf("fail -> %s has no PTR record", q.Name)))
-						}
-					}
+func (t *Server) Run(ctx context.Context) error {
 
-				case dns.TypeCNAME:
-					lookup := getCNameRecord(q.Name)
-					if lookup != nil {
-						record := fmt.Sprintf("%s CNAME %s", q.Name, lookup.GetValue())
+	for _, client := range t.clients {
+		t.addZone(client.GetDomainName(), client.GetDomainName(), client)
+	}
 
-						if logger.Trace {
-							zap.L().Debug(fmt.Sprintf("success -> %s, source=%s", record, lookup.SRC))
-						}
+	// Views inherit the global clients so their reverse zones are synced too
+	onRefresh := func() {
+		t.syncReverseZones()
+		for _, v := range t.views {
+			v.server.syncReverseZones()
+		}
+	}
 
-						rr, err := dns.NewRR(record)
+	for i, client := range t.clients {
+		client.onRefresh = onRefresh
+		err := client.run()
+		if err != nil {
+			for _, started := range t.clients[:i] {
+				started.shutdown()
+			}
+			return err
+		}
+	}
 
-						if err == nil {
-							m.Answer = append(m.Answer, rr)
-						} else {
-							zap.L().Error(err.Error())
-						}
+	t.syncReverseZones()
 
-						// local = true
+	if t.rpz != nil {
+		err := t.rpz.run()
+		if err != nil {
+			for _, client := range t.clients {
+				client.shutdown()
+			}
+			return err
+		}
+		defer t.rpz.shutdown()
+	}
 
-					} else {
-						if logger.Trace {
-							zap.L().Debug((fmt.Sprintf("fail -> %s has no CNAME record", q.Name)))
-						}
-					}
+	if t.blocklist != nil {
+		t.blocklist.run()
+		defer t.blocklist.shutdown()
+	}
 
+	if len(t.forwarders) > 0 {
+		for _, f := range t.forwarders {
+			for _, v := range f.upstreams {
+				if logger.Trace {
+					zap.L().Debug(fmt.Sprintf("Forwarding %s to nameserver %s", f.name, v.String()))
 				}
 			}
 
+			f.run()
+			defer f.shutdown()
 		}
 
-		w.WriteMsg(m)
+	} else {
+		zap.L().Debug("Forwarding to nameservers is not enabled")
 	}
 
-	addDomainName := func(domainName string) {
-		domainName = strings.ToLower(domainName)
-		for _, existingDomain := range t.domainNames {
-			if domainName == existingDomain {
-				return
-			}
+	for _, g := range t.clientGroups {
+
+		if g.blocklist != nil {
+			g.blocklist.run()
+			defer g.blocklist.shutdown()
 		}
-		t.domainNames = append(t.domainNames, domainName)
+
+		if g.forwarder == nil {
+			continue
+		}
+
+		g.forwarder.run()
+		defer g.forwarder.shutdown()
 	}
 
-	for _, client := range t.clients {
-		addDomainName(client.GetDomainName())
-		err := client.run()
+	t.handleForwarders()
+
+	for _, v := range t.views {
+		err := v.run()
 		if err != nil {
+			// Views that have started are shut down by their defer
+			for _, client := range t.clients {
+				client.shutdown()
+			}
 			return err
 		}
+		defer v.shutdown()
 	}
 
-	for _, v := range t.domainNames {
-		zap.L().Debug(fmt.Sprintf("Adding domain %s to be handled locally", v))
-		dns.HandleFunc(v+".", handleLocal)
-	}
+	// started receives the result of each listener binding, stopped receives the
+	// error of a listener that fails after it has started
+	started := make(chan error, len(t.listeners))
+	stopped := make(chan error, len(t.listeners))
+
+	var servers []*dns.Server
+	var wg sync.WaitGroup
+
+	for _, listener := range t.listeners {
+
+		addr := listener.IP + ":" + strconv.Itoa(listener.Port)
 
-	dns.HandleFunc("10.in-addr.arpa.", handleLocal)
-	dns.HandleFunc("168.192.in-addr.arpa.", handleLocal)
-	dns.HandleFunc("0.0.16.127.in-addr.arpa.", handleLocal)
-	dns.HandleFunc("0.0.168.192.in-addr.arpa.", handleLocal)
+		zap.L().Info(fmt.Sprintf("Starting server on %s/%s", addr, string(listener.Proto)))
 
-	if len(t.nameservers) > 0 {
-		for _, v := range t.nameservers {
-			if logger.Trace {
-				zap.L().Debug(fmt.Sprintf("Forwarding to nameserver %s : %s", v.IP, string(v.Proto)))
+		server := &dns.Server{Addr: addr, Net: string(listener.Proto), Handler: dns.HandlerFunc(t.serveDNS)}
+
+		if listener.Proto == proto.TLS {
+			cert, err := util.NewCertificate(listener.CertFile, listener.KeyFile)
+			if err != nil {
+				started <- fmt.Errorf("listener %s/%s failed; error %w", addr, string(listener.Proto), err)
+				continue
+			}
+
+			server.Net = "tcp-tls"
+			server.TLSConfig = &tls.Config{
+				GetCertificate: cert.GetCertificate,
+				MinVersion:     tls.VersionTLS12,
 			}
 		}
 
-		dns.HandleFunc(".", handleRemote)
+		var bound atomic.Bool
 
-	} else {
-		zap.L().Debug("Forwarding to nameservers is not enabled")
-	}
+		server.NotifyStartedFunc = func() {
+			bound.Store(true)
+			started <- nil
+		}
 
-	errs := make(chan error, len(t.listeners))
+		servers = append(servers, server)
+		wg.Add(1)
 
-	for _, listener := range t.listeners {
-		zap.L().Info(fmt.Sprintf("Starting server on %s/%s", listener.IP+":"+strconv.Itoa(listener.Port), string(listener.Proto)))
-		server := &dns.Server{Addr: listener.IP + ":" + strconv.Itoa(listener.Port), Net: string(listener.Proto)}
+		go func(listener *NetPort) {
+			defer wg.Done()
 
-		go func() {
 			err := server.ListenAndServe()
 			if err != nil {
-				errs <- err
+				err = fmt.Errorf("listener %s/%s failed; error %w", addr, string(listener.Proto), err)
+			}
+
+			if !bound.Load() {
+				if err == nil {
+					err = fmt.Errorf("listener %s/%s exited before starting", addr, string(listener.Proto))
+				}
+				started <- err
+				return
+			}
+
+			if err != nil {
+				stopped <- err
 			}
-		}()
+		}(listener)
+	}
+
+	var errs *multierror.Error
 
+	for range t.listeners {
+		if err := <-started; err != nil {
+			errs = multierror.Append(errs, err)
+		}
 	}
 
-	var err error
+	if errs == nil {
+		select {
 
-	select {
+		case err := <-stopped:
+			zap.L().Info("Shutting down or error")
+			errs = multierror.Append(errs, err)
 
-	case err = <-errs:
-		zap.L().Info("Shutting down or error")
+		case <-ctx.Done():
+			zap.L().Info("Shutting down or signal")
 
-	case <-ctx.Done():
-		zap.L().Info("Shutting down or signal")
+		}
+	} else {
+		zap.L().Info("Shutting down on listener error")
+	}
 
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), t.shutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		// Listeners that failed to bind are not started and return an error here
+		server.ShutdownContext(shutdownCtx)
 	}
 
+	wg.Wait()
+	close(stopped)
+
+	for err := range stopped {
+		errs = multierror.Append(errs, err)
+	}
+
+	zap.L().Info("All listeners have exited")
+
 	for _, client := range t.clients {
 		client.shutdown()
 	}
 
-	return err
+	return errs.ErrorOrNil()
 }
@@ -0,0 +1,329 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/jodydadescott/home-dns-server/static"
+	"github.com/jodydadescott/home-dns-server/types"
+	"github.com/jodydadescott/home-dns-server/types/proto"
+)
+
+// testLocalAddr is the listener address queries arrive on unless set
+var testLocalAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+
+// testNameserver starts a nameserver on a random UDP port that answers with the
+// handler and returns its address
+func testNameserver(t *testing.T, handler dns.HandlerFunc) *NetPort {
+
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+
+	server := &dns.Server{
+		PacketConn:        conn,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go server.ActivateAndServe()
+	<-started
+
+	t.Cleanup(func() { server.Shutdown() })
+
+	return &NetPort{IP: "127.0.0.1", Port: conn.LocalAddr().(*net.UDPAddr).Port, Proto: proto.UDP}
+}
+
+// testAnswer returns a handler that answers A queries with the IP and TXT
+// queries with the IP as text
+func testAnswer(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		q := r.Question[0]
+
+		switch q.Qtype {
+
+		case dns.TypeA:
+			rr, _ := dns.NewRR(q.Name + " 60 A " + ip)
+			m.Answer = append(m.Answer, rr)
+
+		case dns.TypeTXT:
+			rr, _ := dns.NewRR(q.Name + " 60 TXT " + ip)
+			m.Answer = append(m.Answer, rr)
+
+		}
+
+		w.WriteMsg(m)
+	}
+}
+
+// testRcode returns a handler that answers every query with the rcode
+func testRcode(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+	}
+}
+
+// testDomain returns the home domain with a few hosts
+func testDomain() *types.Domain {
+
+	d := &types.Domain{Domain: "home"}
+
+	d.Records.AddARecords(
+		&types.ARecord{Hostname: "host1", IP: "192.168.1.1"},
+		&types.ARecord{Hostname: "host2", IP: "192.168.1.2"},
+	)
+
+	return d
+}
+
+// testProviders returns the static providers of the domains
+func testProviders(domains ...*types.Domain) []Provider {
+
+	config := &types.StaticConfig{Enabled: true}
+	config.AddDomains(domains...)
+
+	var providers []Provider
+	for _, v := range static.New(config) {
+		providers = append(providers, v)
+	}
+
+	return providers
+}
+
+// testServer returns a server for the config that is ready to answer queries
+// without binding any listeners. Lists and zones are loaded synchronously.
+func testServer(t *testing.T, config *Config) *Server {
+
+	t.Helper()
+
+	s := New(config)
+
+	for _, client := range s.clients {
+		s.addZone(client.GetDomainName(), client.GetDomainName(), client)
+		if err := client.refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.syncReverseZones()
+
+	if s.rpz != nil {
+		if err := s.rpz.refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.blocklist != nil {
+		if err := s.blocklist.refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, g := range s.clientGroups {
+		if g.blocklist != nil {
+			if err := g.blocklist.refresh(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s.handleForwarders()
+
+	for _, v := range s.views {
+		if err := v.run(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(v.shutdown)
+	}
+
+	return s
+}
+
+// testQuery sends the query from the client IP to the server
+func testQuery(t *testing.T, s *Server, client, name string, qtype uint16) *dns.Msg {
+	return testQueryOn(t, s, testLocalAddr, client, name, qtype)
+}
+
+// testQueryOn sends the query from the client IP to the server on the local address
+func testQueryOn(t *testing.T, s *Server, localAddr net.Addr, client, name string, qtype uint16) *dns.Msg {
+
+	t.Helper()
+
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+
+	var remoteAddr net.Addr = &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}
+	if _, ok := localAddr.(*net.TCPAddr); ok {
+		remoteAddr = &net.TCPAddr{IP: net.ParseIP(client), Port: 5353}
+	}
+
+	resp, err := s.Query(r, localAddr, remoteAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// testAnswerValue returns the value of the first answer or an empty string
+func testAnswerValue(m *dns.Msg) string {
+
+	if len(m.Answer) <= 0 {
+		return ""
+	}
+
+	switch v := m.Answer[0].(type) {
+
+	case *dns.A:
+		return v.A.String()
+
+	case *dns.AAAA:
+		return v.AAAA.String()
+
+	case *dns.PTR:
+		return v.Ptr
+
+	case *dns.CNAME:
+		return v.Target
+
+	case *dns.TXT:
+		if len(v.Txt) > 0 {
+			return v.Txt[0]
+		}
+
+	}
+
+	return ""
+}
+
+func TestFallthroughTypes(t *testing.T) {
+
+	nameserver := testNameserver(t, testAnswer("203.0.113.1"))
+
+	tests := []struct {
+		name   string
+		types  []string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"all types fall through", nil, dns.TypeA, dns.RcodeSuccess, "203.0.113.1"},
+		{"listed type falls through", []string{"TXT"}, dns.TypeTXT, dns.RcodeSuccess, "203.0.113.1"},
+		{"lowercase type falls through", []string{"txt"}, dns.TypeTXT, dns.RcodeSuccess, "203.0.113.1"},
+		{"other type is answered locally", []string{"TXT"}, dns.TypeA, dns.RcodeNameError, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := &Config{
+				Nameservers:      []*NetPort{nameserver},
+				Fallthrough:      []string{"home"},
+				FallthroughTypes: test.types,
+			}
+
+			for _, provider := range testProviders(testDomain()) {
+				config.AddProvider(provider)
+			}
+
+			s := testServer(t, config)
+
+			resp := testQuery(t, s, "192.168.1.50", "missing.home.", test.qtype)
+
+			if resp.Rcode != test.rcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[test.rcode], dns.RcodeToString[resp.Rcode])
+			}
+
+			if v := testAnswerValue(resp); v != test.answer {
+				t.Fatalf("expected answer %q, got %q", test.answer, v)
+			}
+
+			// Names with a local answer never fall through
+			if v := testAnswerValue(testQuery(t, s, "192.168.1.50", "host1.home.", dns.TypeA)); v != "192.168.1.1" {
+				t.Fatalf("expected local answer, got %q", v)
+			}
+		})
+	}
+}
+
+func TestFallthroughTypesInvalid(t *testing.T) {
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for invalid type")
+		}
+	}()
+
+	New(&Config{FallthroughTypes: []string{"BOGUS"}})
+}
+
+func TestReverseZones(t *testing.T) {
+
+	nameserver := testNameserver(t, testAnswer("203.0.113.1"))
+
+	d := testDomain()
+	d.Records.AddARecords(&types.ARecord{Hostname: "public", IP: "8.8.4.4"})
+	d.Records.AAAARecords = append(d.Records.AAAARecords, &types.ARecord{Hostname: "v6", IP: "2001:470:1:2::10"})
+
+	arpa := func(ip string) string {
+		v, _ := dns.ReverseAddr(ip)
+		return v
+	}
+
+	tests := []struct {
+		name          string
+		public        bool
+		ip            string
+		answer        string
+		authoritative bool
+	}{
+		{"private record", false, "192.168.1.1", "host1.home.", true},
+		{"private range", false, "192.168.1.9", "", true},
+		{"public record is forwarded", false, "8.8.4.4", "", false},
+		{"public range is forwarded", false, "8.8.4.9", "", false},
+		{"public record when enabled", true, "8.8.4.4", "public.home.", true},
+		{"public range when enabled", true, "8.8.4.9", "", true},
+		{"ipv6 record", false, "2001:470:1:2::10", "v6.home.", true},
+		{"ipv6 range", false, "2001:470:1:2::99", "", true},
+		{"other ipv6 range is forwarded", false, "2001:470:1:3::10", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := &Config{
+				Nameservers:        []*NetPort{nameserver},
+				PublicReverseZones: test.public,
+			}
+
+			for _, provider := range testProviders(d) {
+				config.AddProvider(provider)
+			}
+
+			s := testServer(t, config)
+
+			resp := testQuery(t, s, "192.168.1.50", arpa(test.ip), dns.TypePTR)
+
+			if v := testAnswerValue(resp); v != test.answer {
+				t.Fatalf("expected answer %q, got %q", test.answer, v)
+			}
+
+			if resp.Authoritative != test.authoritative {
+				t.Fatalf("expected authoritative %v, got %v", test.authoritative, resp.Authoritative)
+			}
+		})
+	}
+}
@@ -14,13 +14,47 @@ type Domain = types.Domain
 type ARecord = types.ARecord
 type PTRrecord = types.PTRrecord
 type CNameRecord = types.CNameRecord
+type MXRecord = types.MXRecord
+type TXTRecord = types.TXTRecord
+type SRVRecord = types.SRVRecord
+type NSRecord = types.NSRecord
+type SOAConfig = types.SOAConfig
+type CacheConfig = types.CacheConfig
+type CacheStats = types.CacheStats
+type UpstreamConfig = types.UpstreamConfig
+type ForwarderConfig = types.ForwarderConfig
+type BlocklistConfig = types.BlocklistConfig
+type BlocklistSource = types.BlocklistSource
+type RPZConfig = types.RPZConfig
+type RPZZoneConfig = types.RPZZoneConfig
+type ClientGroupConfig = types.ClientGroupConfig
+type AccessConfig = types.AccessConfig
+type ACLConfig = types.ACLConfig
 type DomainRecords = types.DomainRecords
 
 type Config struct {
-	Providers   []Provider
-	Trace       bool
-	Listeners   []*NetPort
-	Nameservers []*NetPort
+	Providers    []Provider
+	Trace        bool
+	Listeners    []*NetPort
+	Nameservers  []*NetPort
+	SOA          *SOAConfig
+	RoundRobin   bool
+	TTL          time.Duration
+	Fallthrough  []string
+	ReverseZones []string
+	Cache        *CacheConfig
+	Upstream     *UpstreamConfig
+	Forwarders   []*ForwarderConfig
+	Blocklist    *BlocklistConfig
+	RPZ          *RPZConfig
+	ClientGroups []*ClientGroupConfig
+	Views        []*ViewConfig
+	Access       *AccessConfig
+
+	ShutdownTimeout    time.Duration
+	EDNSBufferSize     uint16
+	PublicReverseZones bool
+	FallthroughTypes   []string
 }
 
 // Clone return copy
@@ -34,9 +68,27 @@ func (t *Config) AddProvider(provider Provider) {
 	t.Providers = append(t.Providers, provider)
 }
 
+func (t *Config) AddViews(views ...*ViewConfig) {
+	t.Views = append(t.Views, views...)
+}
+
+// ViewConfig is a split horizon view that answers from the domains of its
+// providers. Global domains that are not provided by the view are inherited.
+type ViewConfig struct {
+	Name      string
+	CIDRs     []string
+	Listeners []*NetPort
+	Providers []Provider
+}
+
+func (t *ViewConfig) AddProvider(provider Provider) {
+	t.Providers = append(t.Providers, provider)
+}
+
 type Provider interface {
 	GetName() string
 	GetDomainName() string
 	GetRecords() (*DomainRecords, error)
 	GetRefreshDuration() time.Duration
+	GetTTL() time.Duration
 }
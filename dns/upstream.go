@@ -0,0 +1,527 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/jodydadescott/jody-go-logger"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/jodydadescott/home-dns-server/types"
+	"github.com/jodydadescott/home-dns-server/types/proto"
+	"github.com/jodydadescott/home-dns-server/types/strategy"
+)
+
+// upstream is a nameserver that queries are forwarded to. It tracks the round
+// trip time for the fastest strategy and is marked down after maxFailures
+// consecutive failures. Without health checks a down upstream is sent a query
+// every retryInterval so it can recover. Idle TCP and TLS connections are kept
+// for reuse so a handshake is not needed for every query.
+type upstream struct {
+	netPort     *NetPort
+	address     string
+	client      *dns.Client
+	tcpClient   *dns.Client
+	conns       chan *dns.Conn
+	endpoint    *url.URL
+	httpClient  *http.Client
+	maxFailures int32
+	failures    atomic.Int32
+	down        atomic.Bool
+
+	// retryInterval is how long a down upstream is skipped before it is tried
+	// again, zero if it is only brought back by health checks
+	retryInterval time.Duration
+
+	// retryAt is when a down upstream is next tried in unix nanoseconds
+	retryAt atomic.Int64
+
+	// rtt is the smoothed round trip time in nanoseconds
+	rtt atomic.Int64
+}
+
+func newUpstream(netPort *NetPort, timeout time.Duration, maxFailures int, retryInterval time.Duration) *upstream {
+
+	if netPort.Proto == proto.Empty {
+		netPort.Proto = proto.UDP
+	}
+
+	client := &dns.Client{Net: string(netPort.Proto), Timeout: timeout}
+
+	var conns chan *dns.Conn
+	var tcpClient *dns.Client
+	var endpoint *url.URL
+	var httpClient *http.Client
+
+	switch netPort.Proto {
+
+	case proto.UDP:
+		if netPort.Port <= 0 {
+			netPort.Port = types.DefaultDnsPort
+		}
+		tcpClient = &dns.Client{Net: string(proto.TCP), Timeout: timeout}
+
+	case proto.TCP:
+		if netPort.Port <= 0 {
+			netPort.Port = types.DefaultDnsPort
+		}
+		conns = make(chan *dns.Conn, types.DefaultUpstreamIdleConns)
+
+	case proto.TLS:
+		if netPort.Port <= 0 {
+			netPort.Port = types.DefaultDoTPort
+		}
+		if netPort.ServerName == "" {
+			netPort.ServerName = netPort.IP
+		}
+		client.Net = "tcp-tls"
+		client.TLSConfig = newTLSConfig(netPort)
+		conns = make(chan *dns.Conn, types.DefaultUpstreamIdleConns)
+
+	case proto.HTTPS:
+		endpoint = parseHTTPSEndpoint(netPort)
+		httpClient = newHTTPSClient(netPort, endpoint, timeout)
+
+	default:
+		panic("Proto Invalid")
+	}
+
+	address := netPort.GetIPColonPort()
+	if endpoint != nil {
+		address = endpoint.String()
+	}
+
+	return &upstream{
+		netPort:     netPort,
+		address:     address,
+		client:      client,
+		tcpClient:   tcpClient,
+		conns:       conns,
+		endpoint:    endpoint,
+		httpClient:  httpClient,
+		maxFailures: int32(maxFailures),
+
+		retryInterval: retryInterval,
+	}
+}
+
+// newTLSConfig returns the config used to verify the certificate of the
+// nameserver against the server name and the CA file or system roots. For HTTPS
+// an empty server name is taken from the URL.
+func newTLSConfig(netPort *NetPort) *tls.Config {
+
+	config := &tls.Config{
+		ServerName: netPort.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if netPort.CAFile != "" {
+
+		pem, err := os.ReadFile(netPort.CAFile)
+		if err != nil {
+			panic(fmt.Sprintf("unable to read CAFile %s; error is %s", netPort.CAFile, err.Error()))
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			panic(fmt.Sprintf("CAFile %s does not contain any certificates", netPort.CAFile))
+		}
+
+		config.RootCAs = pool
+	}
+
+	return config
+}
+
+func (t *upstream) String() string {
+	if t.endpoint != nil {
+		return t.address
+	}
+	return t.address + "/" + string(t.netPort.Proto)
+}
+
+// exchange sends the request to the nameserver. A response with a rcode other
+// than NOERROR or NXDOMAIN is returned without an error but counts as a failure.
+func (t *upstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+
+	resp, rtt, err := t.roundTrip(r)
+	if err != nil {
+		t.failure(err)
+		return nil, err
+	}
+
+	t.updateRTT(rtt)
+
+	if acceptable(resp) {
+		t.success()
+	} else {
+		t.failure(fmt.Errorf("responded with %s", dns.RcodeToString[resp.Rcode]))
+	}
+
+	return resp, nil
+}
+
+// roundTrip sends the request on an idle connection if there is one. If a
+// reused connection fails the request is retried as the nameserver may have
+// closed the connection while it was idle.
+func (t *upstream) roundTrip(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+
+	if t.httpClient != nil {
+		return t.exchangeHTTPS(r)
+	}
+
+	if t.conns == nil {
+		resp, rtt, err := t.client.Exchange(r, t.address)
+		if err == nil && resp.Truncated && t.tcpClient != nil {
+			// The answer did not fit in UDP so it is retried over TCP
+			return t.tcpClient.Exchange(r, t.address)
+		}
+		return resp, rtt, err
+	}
+
+	conn, reused, err := t.getConn()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, rtt, err := t.client.ExchangeWithConn(r, conn)
+	if err != nil {
+		conn.Close()
+		if reused {
+			return t.roundTrip(r)
+		}
+		return nil, 0, err
+	}
+
+	t.putConn(conn)
+	return resp, rtt, nil
+}
+
+func (t *upstream) getConn() (*dns.Conn, bool, error) {
+
+	select {
+	case conn := <-t.conns:
+		return conn, true, nil
+	default:
+	}
+
+	conn, err := t.client.Dial(t.address)
+	return conn, false, err
+}
+
+func (t *upstream) putConn(conn *dns.Conn) {
+	select {
+	case t.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// close closes the idle connections
+func (t *upstream) close() {
+	if t.httpClient != nil {
+		t.httpClient.CloseIdleConnections()
+	}
+	if t.conns == nil {
+		return
+	}
+	for {
+		select {
+		case conn := <-t.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (t *upstream) updateRTT(rtt time.Duration) {
+	old := t.rtt.Load()
+	if old == 0 {
+		t.rtt.Store(int64(rtt))
+		return
+	}
+	t.rtt.Store((old*7 + int64(rtt)*3) / 10)
+}
+
+func (t *upstream) success() {
+	t.failures.Store(0)
+	if t.down.CompareAndSwap(true, false) {
+		zap.L().Info(fmt.Sprintf("Nameserver %s is up", t.String()))
+	}
+}
+
+func (t *upstream) failure(err error) {
+
+	if t.failures.Add(1) < t.maxFailures {
+		return
+	}
+
+	if t.retryInterval > 0 {
+		t.retryAt.Store(time.Now().Add(t.retryInterval).UnixNano())
+	}
+
+	if t.down.CompareAndSwap(false, true) {
+		zap.L().Warn(fmt.Sprintf("Nameserver %s is down; error is %s", t.String(), err.Error()))
+	}
+}
+
+// retry returns true if the down upstream is due to be tried again. Only one
+// query is let through each retryInterval until the upstream is up.
+func (t *upstream) retry(now time.Time) bool {
+
+	if t.retryInterval <= 0 {
+		return false
+	}
+
+	at := t.retryAt.Load()
+
+	return now.UnixNano() >= at && t.retryAt.CompareAndSwap(at, now.Add(t.retryInterval).UnixNano())
+}
+
+// acceptable returns true if the response is an answer that should be returned
+// to the client. NXDOMAIN is an answer, SERVFAIL and REFUSED are not.
+func acceptable(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError
+}
+
+// forwarder forwards queries for the domain name to a set of upstream
+// nameservers using the configured strategy and health checks them. The
+// forwarder for the root domain handles every name without a more specific one.
+type forwarder struct {
+	name                string
+	strategy            strategy.Strategy
+	upstreams           []*upstream
+	next                atomic.Uint32
+	healthCheckInterval time.Duration
+	healthCheckName     string
+	done                chan bool
+}
+
+func newForwarder(name string, nameservers []*NetPort, config *UpstreamConfig) *forwarder {
+
+	if len(nameservers) <= 0 {
+		panic(fmt.Sprintf("forwarder %s requires nameservers", name))
+	}
+
+	if config == nil {
+		config = &UpstreamConfig{}
+	} else {
+		config = config.Clone()
+	}
+
+	switch config.Strategy {
+
+	case strategy.Sequential, strategy.Random, strategy.RoundRobin, strategy.Fastest, strategy.Parallel:
+
+	case strategy.Empty:
+		config.Strategy = types.DefaultUpstreamStrategy
+
+	default:
+		panic("Strategy Invalid")
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = types.DefaultUpstreamTimeout
+	}
+
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = types.DefaultUpstreamMaxFailures
+	}
+
+	if config.HealthCheckName == "" {
+		config.HealthCheckName = types.DefaultHealthCheckName
+	}
+
+	// Without health checks down upstreams are retried with queries
+	retryInterval := time.Duration(0)
+	if config.HealthCheckInterval <= 0 {
+		retryInterval = config.RetryInterval
+		if retryInterval <= 0 {
+			retryInterval = types.DefaultUpstreamRetryInterval
+		}
+	}
+
+	t := &forwarder{
+		name:                dns.Fqdn(strings.ToLower(name)),
+		strategy:            config.Strategy,
+		healthCheckInterval: config.HealthCheckInterval,
+		healthCheckName:     dns.Fqdn(config.HealthCheckName),
+	}
+
+	for _, nameserver := range nameservers {
+		t.upstreams = append(t.upstreams, newUpstream(nameserver, config.Timeout, config.MaxFailures, retryInterval))
+	}
+
+	return t
+}
+
+// order returns the upstreams that are up or due to be retried in the order
+// they should be tried. If every upstream is down they are all returned.
+func (t *forwarder) order() []*upstream {
+
+	now := time.Now()
+
+	var upstreams []*upstream
+	for _, u := range t.upstreams {
+		if !u.down.Load() || u.retry(now) {
+			upstreams = append(upstreams, u)
+		}
+	}
+
+	if len(upstreams) <= 0 {
+		upstreams = append(upstreams, t.upstreams...)
+	}
+
+	switch t.strategy {
+
+	case strategy.Random:
+		rand.Shuffle(len(upstreams), func(i, j int) {
+			upstreams[i], upstreams[j] = upstreams[j], upstreams[i]
+		})
+
+	case strategy.RoundRobin:
+		n := int(t.next.Add(1)-1) % len(upstreams)
+		upstreams = append(upstreams[n:], upstreams[:n]...)
+
+	case strategy.Fastest:
+		// Upstreams without a round trip time yet are tried first so they get one
+		sort.SliceStable(upstreams, func(i, j int) bool {
+			return upstreams[i].rtt.Load() < upstreams[j].rtt.Load()
+		})
+
+	}
+
+	return upstreams
+}
+
+// exchange forwards the request and returns the first acceptable response
+func (t *forwarder) exchange(r *dns.Msg) (*dns.Msg, error) {
+
+	upstreams := t.order()
+
+	if t.strategy == strategy.Parallel {
+		return t.race(r, upstreams)
+	}
+
+	for _, u := range upstreams {
+
+		resp, err := u.exchange(r)
+		if err != nil {
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Remote Nameserver %s responded with error %s", u.String(), err.Error()))
+			}
+			continue
+		}
+
+		if logger.Trace {
+			zap.L().Debug(fmt.Sprintf("Remote Nameserver %s responded with %s", u.String(), dns.RcodeToString[resp.Rcode]))
+		}
+
+		if acceptable(resp) {
+			return resp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failure to forward request")
+}
+
+// race sends the request to every upstream at once and returns the first
+// acceptable response
+func (t *forwarder) race(r *dns.Msg, upstreams []*upstream) (*dns.Msg, error) {
+
+	results := make(chan *dns.Msg, len(upstreams))
+
+	for _, u := range upstreams {
+		go func(u *upstream, r *dns.Msg) {
+			resp, err := u.exchange(r)
+			if err != nil {
+				if logger.Trace {
+					zap.L().Debug(fmt.Sprintf("Remote Nameserver %s responded with error %s", u.String(), err.Error()))
+				}
+				results <- nil
+				return
+			}
+			results <- resp
+		}(u, r.Copy())
+	}
+
+	for range upstreams {
+		resp := <-results
+		if resp != nil && acceptable(resp) {
+			return resp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failure to forward request")
+}
+
+// healthCheck queries every upstream for the NS records of the health check name
+func (t *forwarder) healthCheck() {
+
+	m := new(dns.Msg)
+	m.SetQuestion(t.healthCheckName, dns.TypeNS)
+
+	for _, u := range t.upstreams {
+		// The exchange counts the success or failure of the nameserver
+		resp, err := u.exchange(m)
+		if err != nil {
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Health check of %s failed; error is %s", u.String(), err.Error()))
+			}
+			continue
+		}
+
+		if !acceptable(resp) && logger.Trace {
+			zap.L().Debug(fmt.Sprintf("Health check of %s responded with %s", u.String(), dns.RcodeToString[resp.Rcode]))
+		}
+	}
+}
+
+func (t *forwarder) run() {
+
+	if t.healthCheckInterval <= 0 {
+		zap.L().Debug(fmt.Sprintf("Nameserver health checks for %s are not enabled", t.name))
+		return
+	}
+
+	zap.L().Info(fmt.Sprintf("Nameserver health check interval for %s is %s", t.name, t.healthCheckInterval.String()))
+
+	done := make(chan bool)
+	t.done = done
+	ticker := time.NewTicker(t.healthCheckInterval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				t.healthCheck()
+
+			}
+		}
+	}()
+}
+
+func (t *forwarder) shutdown() {
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
+	for _, u := range t.upstreams {
+		u.close()
+	}
+}
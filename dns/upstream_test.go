@@ -0,0 +1,334 @@
+package dns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jodydadescott/home-dns-server/types/strategy"
+)
+
+// testFlaky returns a handler that answers with SERVFAIL while failing is set
+// and counts the queries it receives
+func testFlaky(failing *atomic.Bool, queries *atomic.Int32, ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		if failing.Load() {
+			testRcode(dns.RcodeServerFailure)(w, r)
+			return
+		}
+		testAnswer(ip)(w, r)
+	}
+}
+
+func testForwardQuery(t *testing.T, f *forwarder) *dns.Msg {
+
+	t.Helper()
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+
+	resp, err := f.exchange(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestUpstreamRecovers(t *testing.T) {
+
+	var failing atomic.Bool
+	var queries atomic.Int32
+
+	failing.Store(true)
+
+	first := testNameserver(t, testFlaky(&failing, &queries, "203.0.113.1"))
+	second := testNameserver(t, testAnswer("203.0.113.2"))
+
+	f := newForwarder(".", []*NetPort{first, second}, &UpstreamConfig{
+		MaxFailures:   3,
+		RetryInterval: 100 * time.Millisecond,
+	})
+
+	// The failures of the first nameserver are answered by the second
+	for i := 0; i < 3; i++ {
+		if v := testAnswerValue(testForwardQuery(t, f)); v != "203.0.113.2" {
+			t.Fatalf("expected answer from second nameserver, got %q", v)
+		}
+	}
+
+	if !f.upstreams[0].down.Load() {
+		t.Fatal("expected first nameserver to be down")
+	}
+
+	failing.Store(false)
+	queries.Store(0)
+
+	// A down nameserver is skipped until the retry interval has passed
+	testForwardQuery(t, f)
+
+	if queries.Load() != 0 {
+		t.Fatal("expected down nameserver to be skipped")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if v := testAnswerValue(testForwardQuery(t, f)); v != "203.0.113.1" {
+		t.Fatalf("expected answer from recovered nameserver, got %q", v)
+	}
+
+	if f.upstreams[0].down.Load() {
+		t.Fatal("expected first nameserver to be up")
+	}
+
+	for i := 0; i < 10; i++ {
+		testForwardQuery(t, f)
+	}
+
+	if queries.Load() != 11 {
+		t.Fatalf("expected recovered nameserver to get every query, got %d", queries.Load())
+	}
+}
+
+func TestUpstreamRetryFails(t *testing.T) {
+
+	var failing atomic.Bool
+	var queries atomic.Int32
+
+	failing.Store(true)
+
+	first := testNameserver(t, testFlaky(&failing, &queries, "203.0.113.1"))
+	second := testNameserver(t, testAnswer("203.0.113.2"))
+
+	f := newForwarder(".", []*NetPort{first, second}, &UpstreamConfig{
+		MaxFailures:   1,
+		RetryInterval: 100 * time.Millisecond,
+	})
+
+	testForwardQuery(t, f)
+	time.Sleep(150 * time.Millisecond)
+
+	// The retry fails so the nameserver stays down for another interval
+	queries.Store(0)
+
+	for i := 0; i < 5; i++ {
+		testForwardQuery(t, f)
+	}
+
+	if queries.Load() != 1 {
+		t.Fatalf("expected a single retry, got %d", queries.Load())
+	}
+
+	if !f.upstreams[0].down.Load() {
+		t.Fatal("expected first nameserver to stay down")
+	}
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+
+	var failing atomic.Bool
+	var queries atomic.Int32
+
+	failing.Store(true)
+
+	first := testNameserver(t, testFlaky(&failing, &queries, "203.0.113.1"))
+	second := testNameserver(t, testAnswer("203.0.113.2"))
+
+	// With health checks down nameservers are not retried with queries
+	f := newForwarder(".", []*NetPort{first, second}, &UpstreamConfig{
+		MaxFailures:         1,
+		HealthCheckInterval: time.Hour,
+		RetryInterval:       time.Millisecond,
+	})
+
+	testForwardQuery(t, f)
+	failing.Store(false)
+	time.Sleep(10 * time.Millisecond)
+	queries.Store(0)
+
+	testForwardQuery(t, f)
+
+	if queries.Load() != 0 {
+		t.Fatal("expected down nameserver to be skipped")
+	}
+
+	f.healthCheck()
+
+	if f.upstreams[0].down.Load() {
+		t.Fatal("expected health check to bring the nameserver up")
+	}
+
+	if v := testAnswerValue(testForwardQuery(t, f)); v != "203.0.113.1" {
+		t.Fatalf("expected answer from first nameserver, got %q", v)
+	}
+}
+
+func TestForwarderOrder(t *testing.T) {
+
+	nameservers := []*NetPort{
+		{IP: "192.0.2.1", Port: 53},
+		{IP: "192.0.2.2", Port: 53},
+		{IP: "192.0.2.3", Port: 53},
+	}
+
+	order := func(f *forwarder) string {
+		v := ""
+		for _, u := range f.order() {
+			v += u.netPort.IP[len(u.netPort.IP)-1:]
+		}
+		return v
+	}
+
+	tests := []struct {
+		name     string
+		strategy strategy.Strategy
+		setup    func(f *forwarder)
+		expected []string
+	}{
+		{"sequential", strategy.Sequential, nil, []string{"123", "123"}},
+		{"round robin", strategy.RoundRobin, nil, []string{"123", "231", "312", "123"}},
+		{"fastest", strategy.Fastest, func(f *forwarder) {
+			f.upstreams[0].rtt.Store(int64(30 * time.Millisecond))
+			f.upstreams[1].rtt.Store(int64(10 * time.Millisecond))
+			f.upstreams[2].rtt.Store(int64(20 * time.Millisecond))
+		}, []string{"231"}},
+		{"fastest tries unmeasured first", strategy.Fastest, func(f *forwarder) {
+			f.upstreams[0].rtt.Store(int64(30 * time.Millisecond))
+			f.upstreams[1].rtt.Store(int64(10 * time.Millisecond))
+		}, []string{"321"}},
+		{"down is skipped", strategy.Sequential, func(f *forwarder) {
+			f.upstreams[1].down.Store(true)
+			f.upstreams[1].retryAt.Store(time.Now().Add(time.Hour).UnixNano())
+		}, []string{"13"}},
+		{"every one down is tried", strategy.Sequential, func(f *forwarder) {
+			for _, u := range f.upstreams {
+				u.down.Store(true)
+				u.retryAt.Store(time.Now().Add(time.Hour).UnixNano())
+			}
+		}, []string{"123"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			f := newForwarder(".", nameservers, &UpstreamConfig{Strategy: test.strategy})
+
+			if test.setup != nil {
+				test.setup(f)
+			}
+
+			for _, expected := range test.expected {
+				if v := order(f); v != expected {
+					t.Fatalf("expected order %s, got %s", expected, v)
+				}
+			}
+		})
+	}
+}
+
+func TestForwarderRandom(t *testing.T) {
+
+	f := newForwarder(".", []*NetPort{
+		{IP: "192.0.2.1", Port: 53},
+		{IP: "192.0.2.2", Port: 53},
+		{IP: "192.0.2.3", Port: 53},
+	}, &UpstreamConfig{Strategy: strategy.Random})
+
+	first := make(map[string]bool)
+
+	for i := 0; i < 100; i++ {
+		upstreams := f.order()
+		if len(upstreams) != 3 {
+			t.Fatalf("expected 3 upstreams, got %d", len(upstreams))
+		}
+		first[upstreams[0].netPort.IP] = true
+	}
+
+	if len(first) < 2 {
+		t.Fatal("expected random order")
+	}
+}
+
+func TestForwarderExchange(t *testing.T) {
+
+	servfail := testNameserver(t, testRcode(dns.RcodeServerFailure))
+	refused := testNameserver(t, testRcode(dns.RcodeRefused))
+	good := testNameserver(t, testAnswer("203.0.113.1"))
+
+	tests := []struct {
+		name        string
+		strategy    strategy.Strategy
+		nameservers []*NetPort
+		answer      string
+	}{
+		{"sequential skips SERVFAIL", strategy.Sequential, []*NetPort{servfail, good}, "203.0.113.1"},
+		{"sequential skips REFUSED", strategy.Sequential, []*NetPort{refused, good}, "203.0.113.1"},
+		{"parallel returns the acceptable answer", strategy.Parallel, []*NetPort{servfail, refused, good}, "203.0.113.1"},
+		{"no acceptable answer", strategy.Sequential, []*NetPort{servfail, refused}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			f := newForwarder(".", test.nameservers, &UpstreamConfig{Strategy: test.strategy})
+
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+
+			resp, err := f.exchange(r)
+
+			if test.answer == "" {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v := testAnswerValue(resp); v != test.answer {
+				t.Fatalf("expected answer %q, got %q", test.answer, v)
+			}
+		})
+	}
+}
+
+func TestUpstreamFailures(t *testing.T) {
+
+	servfail := testNameserver(t, testRcode(dns.RcodeServerFailure))
+	nxdomain := testNameserver(t, testRcode(dns.RcodeNameError))
+
+	tests := []struct {
+		name       string
+		nameserver *NetPort
+		down       bool
+	}{
+		{"SERVFAIL counts as a failure", servfail, true},
+		{"NXDOMAIN is an answer", nxdomain, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			u := newUpstream(test.nameserver, time.Second, 3, 0)
+
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+
+			for i := 0; i < 3; i++ {
+				if _, err := u.exchange(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if u.down.Load() != test.down {
+				t.Fatalf("expected down %v", test.down)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	logger "github.com/jodydadescott/jody-go-logger"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/jodydadescott/home-dns-server/types/proto"
+)
+
+// view is a split horizon view. The server of the view has its own clients,
+// zones and mux and shares the forwarders, cache and policies of the parent.
+// Only the clients of the view's own providers are run by the view, the
+// inherited clients are run by the parent.
+type view struct {
+	name      string
+	networks  []*net.IPNet
+	listeners []*NetPort
+	server    *Server
+	clients   []*Client
+}
+
+func newView(parent *Server, config *ViewConfig) *view {
+
+	if config == nil {
+		panic("config is required")
+	}
+
+	if config.Name == "" {
+		panic("view requires a name")
+	}
+
+	if len(config.CIDRs) <= 0 && len(config.Listeners) <= 0 {
+		panic(fmt.Sprintf("view %s requires CIDRs or listeners", config.Name))
+	}
+
+	v := &view{
+		name:      config.Name,
+		listeners: config.Listeners,
+	}
+
+	for _, cidr := range config.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(fmt.Sprintf("view %s CIDR %s is invalid", config.Name, cidr))
+		}
+		v.networks = append(v.networks, network)
+	}
+
+	for _, listener := range config.Listeners {
+		if listener == nil || listener.Port <= 0 {
+			panic(fmt.Sprintf("view %s listener requires a port", config.Name))
+		}
+	}
+
+	v.server = &Server{
+		mux:          dns.NewServeMux(),
+		origin:       parent.origin,
+		reverseZones: parent.reverseZones,
+		soa:          parent.soa,
+		forwarders:   parent.forwarders,
+		roundRobin:   parent.roundRobin,
+		ttl:          parent.ttl,
+		fallthroughs: parent.fallthroughs,
+		cache:        parent.cache,
+		blocklist:    parent.blocklist,
+		rpz:          parent.rpz,
+		clientGroups: parent.clientGroups,
+		listeners:    parent.listeners,
+		access:       parent.access,
+
+		listenerAccess: parent.listenerAccess,
+
+		ednsBufferSize:     parent.ednsBufferSize,
+		publicReverseZones: parent.publicReverseZones,
+		fallthroughTypes:   parent.fallthroughTypes,
+		shutdownTimeout:    parent.shutdownTimeout,
+	}
+
+	domains := make(map[string]bool)
+
+	for _, provider := range config.Providers {
+		if provider == nil {
+			panic("nil provider")
+		}
+		client := newClient(provider)
+		domains[dns.Fqdn(strings.ToLower(client.GetDomainName()))] = true
+		v.clients = append(v.clients, client)
+	}
+
+	v.server.clients = append(v.server.clients, v.clients...)
+
+	// Global domains that the view does not provide are answered as is
+	for _, client := range parent.clients {
+		if !domains[dns.Fqdn(strings.ToLower(client.GetDomainName()))] {
+			v.server.clients = append(v.server.clients, client)
+		}
+	}
+
+	if len(v.clients) > 0 {
+		v.server.origin = v.clients[0].GetDomainName()
+	}
+
+	return v
+}
+
+// run adds the zones of the view and starts the clients of the view
+func (t *view) run() error {
+
+	for _, client := range t.server.clients {
+		t.server.addZone(client.GetDomainName(), client.GetDomainName(), client)
+	}
+
+	for i, client := range t.clients {
+		client.onRefresh = t.server.syncReverseZones
+		err := client.run()
+		if err != nil {
+			for _, started := range t.clients[:i] {
+				started.shutdown()
+			}
+			return err
+		}
+	}
+
+	t.server.syncReverseZones()
+	t.server.handleForwarders()
+
+	return nil
+}
+
+func (t *view) shutdown() {
+	for _, client := range t.clients {
+		client.shutdown()
+	}
+}
+
+// matches returns true if the client address is in the CIDRs of the view and
+// the query arrived on one of the listeners of the view
+func (t *view) matches(localAddr, remoteAddr net.Addr) bool {
+
+	if len(t.networks) > 0 {
+
+		ip := addrIP(remoteAddr)
+		if ip == nil {
+			return false
+		}
+
+		found := false
+		for _, network := range t.networks {
+			if network.Contains(ip) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(t.listeners) <= 0 {
+		return true
+	}
+
+	for _, listener := range t.listeners {
+		if listenerMatches(listener, localAddr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listenerMatches returns true if the local address of the query is the
+// address of the listener
+func listenerMatches(listener *NetPort, localAddr net.Addr) bool {
+
+	ip := addrIP(localAddr)
+	if ip == nil {
+		return false
+	}
+
+	port := 0
+	network := proto.Empty
+
+	switch v := localAddr.(type) {
+
+	case *net.UDPAddr:
+		port = v.Port
+		network = proto.UDP
+
+	case *net.TCPAddr:
+		port = v.Port
+		network = proto.TCP
+
+	}
+
+	if listener.Port != port {
+		return false
+	}
+
+	// A listener on the unspecified address gets queries for every address
+	if listener.IP != "" {
+		listenerIP := net.ParseIP(listener.IP)
+		if !listenerIP.IsUnspecified() && !listenerIP.Equal(ip) {
+			return false
+		}
+	}
+
+	switch listener.Proto {
+
+	case proto.Empty:
+
+	case proto.UDP:
+		if network != proto.UDP {
+			return false
+		}
+
+	default:
+		// TCP, TLS and HTTPS are all on TCP
+		if network != proto.TCP {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getView returns the first view that matches the query or nil
+func (t *Server) getView(w dns.ResponseWriter) *view {
+
+	for _, v := range t.views {
+		if v.matches(w.LocalAddr(), w.RemoteAddr()) {
+			if logger.Trace {
+				zap.L().Debug(fmt.Sprintf("Client %s is in view %s", w.RemoteAddr().String(), v.name))
+			}
+			return v
+		}
+	}
+
+	return nil
+}
+
+// addrIP returns the IP of a UDP or TCP address or nil
+func addrIP(addr net.Addr) net.IP {
+
+	switch v := addr.(type) {
+
+	case *net.UDPAddr:
+		return v.IP
+
+	case *net.TCPAddr:
+		return v.IP
+
+	}
+
+	return nil
+}
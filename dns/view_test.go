@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/jodydadescott/home-dns-server/types"
+	"github.com/jodydadescott/home-dns-server/types/proto"
+)
+
+// testViewDomain returns the home domain with host1 at the IP
+func testViewDomain(ip string) *types.Domain {
+	d := &types.Domain{Domain: "home"}
+	d.Records.AddARecords(&types.ARecord{Hostname: "host1", IP: ip})
+	return d
+}
+
+func TestViews(t *testing.T) {
+
+	nameserver := testNameserver(t, testAnswer("203.0.113.1"))
+
+	lab := &types.Domain{Domain: "lab"}
+	lab.Records.AddARecords(&types.ARecord{Hostname: "host1", IP: "192.168.2.1"})
+
+	config := &Config{
+		Nameservers:  []*NetPort{nameserver},
+		ReverseZones: []string{"172.16.0.0/24"},
+	}
+
+	for _, provider := range testProviders(testDomain(), lab) {
+		config.AddProvider(provider)
+	}
+
+	views := []struct {
+		name      string
+		cidrs     []string
+		listeners []*NetPort
+		ip        string
+	}{
+		{"guest", []string{"192.168.50.0/24"}, nil, "10.0.50.1"},
+		{"dot", nil, []*NetPort{{IP: "127.0.0.1", Port: 853, Proto: proto.TLS}}, "10.0.99.1"},
+		{"shadowed", []string{"192.168.50.0/25"}, nil, "10.0.51.1"},
+	}
+
+	for _, v := range views {
+		viewConfig := &ViewConfig{Name: v.name, CIDRs: v.cidrs, Listeners: v.listeners}
+		for _, provider := range testProviders(testViewDomain(v.ip)) {
+			viewConfig.AddProvider(provider)
+		}
+		config.AddViews(viewConfig)
+	}
+
+	s := testServer(t, config)
+
+	udp853 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 853}
+	tcp853 := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 853}
+
+	arpa := func(ip string) string {
+		v, _ := dns.ReverseAddr(ip)
+		return v
+	}
+
+	tests := []struct {
+		name          string
+		localAddr     net.Addr
+		client        string
+		qname         string
+		qtype         uint16
+		rcode         int
+		answer        string
+		authoritative bool
+	}{
+		{"no view", testLocalAddr, "192.168.1.50", "host1.home.", dns.TypeA, dns.RcodeSuccess, "192.168.1.1", true},
+		{"view by CIDR", testLocalAddr, "192.168.50.5", "host1.home.", dns.TypeA, dns.RcodeSuccess, "10.0.50.1", true},
+		{"first view wins", testLocalAddr, "192.168.50.200", "host1.home.", dns.TypeA, dns.RcodeSuccess, "10.0.50.1", true},
+		{"view domain replaces the global domain", testLocalAddr, "192.168.50.5", "host2.home.", dns.TypeA, dns.RcodeNameError, "", true},
+		{"global domain is inherited", testLocalAddr, "192.168.50.5", "host1.lab.", dns.TypeA, dns.RcodeSuccess, "192.168.2.1", true},
+		{"view by listener", tcp853, "192.168.1.50", "host1.home.", dns.TypeA, dns.RcodeSuccess, "10.0.99.1", true},
+		{"listener protocol must match", udp853, "192.168.1.50", "host1.home.", dns.TypeA, dns.RcodeSuccess, "192.168.1.1", true},
+		{"view forwards", testLocalAddr, "192.168.50.5", "www.example.com.", dns.TypeA, dns.RcodeSuccess, "203.0.113.1", false},
+		{"view reverse zone of its records", testLocalAddr, "192.168.50.5", arpa("10.0.50.1"), dns.TypePTR, dns.RcodeSuccess, "host1.home.", true},
+		{"view reverse zone of inherited records", testLocalAddr, "192.168.50.5", arpa("192.168.2.1"), dns.TypePTR, dns.RcodeSuccess, "host1.lab.", true},
+		{"view configured reverse zone", testLocalAddr, "192.168.50.5", arpa("172.16.0.5"), dns.TypePTR, dns.RcodeNameError, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			resp := testQueryOn(t, s, test.localAddr, test.client, test.qname, test.qtype)
+
+			if resp.Rcode != test.rcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[test.rcode], dns.RcodeToString[resp.Rcode])
+			}
+
+			if v := testAnswerValue(resp); v != test.answer {
+				t.Fatalf("expected answer %q, got %q", test.answer, v)
+			}
+
+			if resp.Authoritative != test.authoritative {
+				t.Fatalf("expected authoritative %v, got %v", test.authoritative, resp.Authoritative)
+			}
+		})
+	}
+}
+
+func TestViewInvalid(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config *ViewConfig
+	}{
+		{"no name", &ViewConfig{CIDRs: []string{"192.168.50.0/24"}}},
+		{"no CIDRs or listeners", &ViewConfig{Name: "guest"}},
+		{"invalid CIDR", &ViewConfig{Name: "guest", CIDRs: []string{"192.168.50.0"}}},
+		{"listener without port", &ViewConfig{Name: "guest", Listeners: []*NetPort{{IP: "127.0.0.1"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected panic")
+				}
+			}()
+
+			New(&Config{Views: []*ViewConfig{test.config}})
+		})
+	}
+}
+
+func TestListenerMatches(t *testing.T) {
+
+	udp := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 53}
+	tcp := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 53}
+	tcp6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}
+
+	tests := []struct {
+		name      string
+		listener  *NetPort
+		localAddr net.Addr
+		matches   bool
+	}{
+		{"same address", &NetPort{IP: "192.168.1.1", Port: 53, Proto: proto.UDP}, udp, true},
+		{"other address", &NetPort{IP: "192.168.1.2", Port: 53, Proto: proto.UDP}, udp, false},
+		{"other port", &NetPort{IP: "192.168.1.1", Port: 5353, Proto: proto.UDP}, udp, false},
+		{"other protocol", &NetPort{IP: "192.168.1.1", Port: 53, Proto: proto.UDP}, tcp, false},
+		{"TLS is TCP", &NetPort{IP: "192.168.1.1", Port: 53, Proto: proto.TLS}, tcp, true},
+		{"any protocol", &NetPort{IP: "192.168.1.1", Port: 53}, tcp, true},
+		{"no address", &NetPort{Port: 53, Proto: proto.TCP}, tcp, true},
+		{"IPv4 unspecified", &NetPort{IP: "0.0.0.0", Port: 53, Proto: proto.TCP}, tcp, true},
+		{"IPv6 unspecified", &NetPort{IP: "::", Port: 53, Proto: proto.TCP}, tcp6, true},
+		{"unspecified other port", &NetPort{IP: "0.0.0.0", Port: 5353, Proto: proto.TCP}, tcp, false},
+		{"unspecified other protocol", &NetPort{IP: "0.0.0.0", Port: 53, Proto: proto.UDP}, tcp, false},
+		{"no local address", &NetPort{Port: 53}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if v := listenerMatches(test.listener, test.localAddr); v != test.matches {
+				t.Fatalf("expected matches %v, got %v", test.matches, v)
+			}
+		})
+	}
+}
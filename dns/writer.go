@@ -0,0 +1,68 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// responseWriter captures the response to a query that did not arrive on a
+// DNS listener, such as DNS over HTTPS
+type responseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (t *responseWriter) LocalAddr() net.Addr {
+	return t.localAddr
+}
+
+func (t *responseWriter) RemoteAddr() net.Addr {
+	return t.remoteAddr
+}
+
+func (t *responseWriter) WriteMsg(m *dns.Msg) error {
+	t.msg = m
+	return nil
+}
+
+func (t *responseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	t.msg = m
+	return len(b), nil
+}
+
+func (t *responseWriter) Close() error {
+	return nil
+}
+
+func (t *responseWriter) TsigStatus() error {
+	return nil
+}
+
+func (t *responseWriter) TsigTimersOnly(bool) {}
+
+func (t *responseWriter) Hijack() {}
+
+// Query answers the request with the same handlers as the listeners. It is used
+// for queries that arrive on other transports such as DNS over HTTPS.
+func (t *Server) Query(r *dns.Msg, localAddr, remoteAddr net.Addr) (*dns.Msg, error) {
+
+	w := &responseWriter{
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+	}
+
+	t.serveDNS(w, r)
+
+	if w.msg == nil {
+		return nil, fmt.Errorf("no response to query")
+	}
+
+	return w.msg, nil
+}
@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/jodydadescott/home-dns-server/types"
+)
+
+// zone is a locally served domain. The SOA and NS records for the zone are
+// synthesized from the SOA config and the serial is derived from the
+// generation of the clients that provide records for the zone.
+type zone struct {
+	name    string
+	soa     *SOAConfig
+	ttl     time.Duration
+	clients []*Client
+
+	// fallthrough is true if queries without a local answer are forwarded
+	fallThrough bool
+}
+
+// newZone returns a zone with the name. Relative SOA names are qualified with the
+// origin which is the zone itself for domains and the first domain for reverse zones.
+func newZone(name, origin string, soa *SOAConfig, ttl time.Duration) *zone {
+
+	name = dns.Fqdn(strings.ToLower(name))
+	origin = dns.Fqdn(strings.ToLower(origin))
+
+	if soa == nil {
+		soa = &SOAConfig{}
+	} else {
+		soa = soa.Clone()
+	}
+
+	if soa.Serial == 0 {
+		soa.Serial = uint32(time.Now().Unix())
+	}
+
+	if soa.Mname == "" {
+		soa.Mname = types.DefaultSOAMname
+	}
+
+	if soa.Rname == "" {
+		soa.Rname = types.DefaultSOARname
+	}
+
+	if soa.Refresh <= 0 {
+		soa.Refresh = types.DefaultSOARefresh
+	}
+
+	if soa.Retry <= 0 {
+		soa.Retry = types.DefaultSOARetry
+	}
+
+	if soa.Expire <= 0 {
+		soa.Expire = types.DefaultSOAExpire
+	}
+
+	if soa.Minttl <= 0 {
+		soa.Minttl = types.DefaultSOAMinttl
+	}
+
+	soa.Mname = qualify(soa.Mname, origin)
+	soa.Rname = qualify(strings.Replace(soa.Rname, "@", ".", 1), origin)
+
+	return &zone{
+		name: name,
+		soa:  soa,
+		ttl:  ttl,
+	}
+}
+
+// qualify returns the name as a fqdn. Names without a trailing dot are
+// considered to be relative to the zone.
+func qualify(name, zoneName string) string {
+	if dns.IsFqdn(name) {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name) + "." + zoneName
+}
+
+func (t *zone) addClient(client *Client) {
+	for _, existing := range t.clients {
+		if existing == client {
+			return
+		}
+	}
+	t.clients = append(t.clients, client)
+}
+
+// isApex returns true if the name is the zone itself
+func (t *zone) isApex(name string) bool {
+	return strings.ToLower(name) == t.name
+}
+
+func (t *zone) getSerial() uint32 {
+	serial := t.soa.Serial
+	for _, client := range t.clients {
+		serial += client.getGeneration()
+	}
+	return serial
+}
+
+func (t *zone) getSOA() dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   t.name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(t.soa.Minttl.Seconds()),
+		},
+		Ns:      t.soa.Mname,
+		Mbox:    t.soa.Rname,
+		Serial:  t.getSerial(),
+		Refresh: uint32(t.soa.Refresh.Seconds()),
+		Retry:   uint32(t.soa.Retry.Seconds()),
+		Expire:  uint32(t.soa.Expire.Seconds()),
+		Minttl:  uint32(t.soa.Minttl.Seconds()),
+	}
+}
+
+// getNS returns the NS records for the zone. If a provider has NS records for
+// the apex they are used, otherwise a single NS record with the mname is
+// synthesized.
+func (t *zone) getNS() []dns.RR {
+
+	var records []dns.RR
+
+	for _, client := range t.clients {
+		for _, v := range client.getNSRecords(t.name) {
+			ttl := v.TTL
+			if ttl <= 0 {
+				ttl = t.ttl
+			}
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d NS %s", t.name, uint32(ttl.Seconds()), v.GetValue()))
+			if err != nil {
+				zap.L().Error(err.Error())
+				continue
+			}
+			records = append(records, rr)
+		}
+		if len(records) > 0 {
+			return records
+		}
+	}
+
+	ttl := t.ttl
+	for _, client := range t.clients {
+		if client.GetTTL() > 0 {
+			ttl = client.GetTTL()
+			break
+		}
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d NS %s", t.name, uint32(ttl.Seconds()), t.soa.Mname))
+	if err != nil {
+		zap.L().Error(err.Error())
+		return nil
+	}
+
+	return append(records, rr)
+}
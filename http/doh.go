@@ -0,0 +1,115 @@
+package http
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+)
+
+// serveDNSQuery answers a DNS over HTTPS (RFC 8484) GET or POST request
+func (t *Server) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+
+	var buf []byte
+	var err error
+
+	switch r.Method {
+
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "dns parameter is required", http.StatusBadRequest)
+			return
+		}
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageContentType {
+			http.Error(w, "Content-Type must be "+dnsMessageContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var localAddr net.Addr
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr
+	}
+
+	// The client address is matched by views, client groups and access rules
+	// so a query without one is not answered
+	remoteAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := t.queryProvider.Query(req, localAddr, remoteAddr)
+	if err != nil {
+		zap.L().Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := resp.Pack()
+	if err != nil {
+		zap.L().Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dnsMessageContentType)
+
+	// The freshness of the response is the lowest TTL (RFC 8484 5.1)
+	if ttl, ok := minTTL(resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+
+	w.Write(out)
+}
+
+// minTTL returns the lowest TTL of the records ignoring OPT
+func minTTL(m *dns.Msg) (uint32, bool) {
+
+	var ttl uint32
+	found := false
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/jodydadescott/home-dns-server/types"
+	"github.com/jodydadescott/home-dns-server/util"
 )
 
 type NetPort = types.NetPort
@@ -25,6 +27,10 @@ type HTTPRequest struct {
 type Server struct {
 	s              *http.Server
 	recordProvider RecordProvider
+	cacheProvider  CacheProvider
+	queryProvider  QueryProvider
+	certFile       string
+	keyFile        string
 }
 
 // NewServer ...
@@ -44,6 +50,10 @@ func New(config *Config) *Server {
 
 	s := &Server{
 		recordProvider: config.RecordProvider,
+		cacheProvider:  config.CacheProvider,
+		queryProvider:  config.QueryProvider,
+		certFile:       config.Listener.CertFile,
+		keyFile:        config.Listener.KeyFile,
 	}
 	s.s = &http.Server{Addr: config.Listener.GetIPColonPort(), Handler: s}
 	return s
@@ -57,8 +67,33 @@ func (t *Server) Run(ctx context.Context) error {
 		t.s.Shutdown(ctx)
 	}()
 
-	zap.L().Info("Starting HTTP Server")
-	return t.s.ListenAndServe()
+	var err error
+
+	if t.certFile != "" || t.keyFile != "" {
+
+		cert, certErr := util.NewCertificate(t.certFile, t.keyFile)
+		if certErr != nil {
+			return certErr
+		}
+
+		t.s.TLSConfig = &tls.Config{
+			GetCertificate: cert.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+
+		zap.L().Info("Starting HTTPS Server")
+		err = t.s.ListenAndServeTLS("", "")
+
+	} else {
+		zap.L().Info("Starting HTTP Server")
+		err = t.s.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
 }
 
 func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -101,6 +136,38 @@ func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		write(newRecords)
 
+		return
+
+	case "/dns-query":
+		if t.queryProvider == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		t.serveDNSQuery(w, r)
+
+		return
+
+	case "/cachestats":
+		w.Header().Set("Content-Type", "application/json")
+
+		var stats *CacheStats
+		if t.cacheProvider != nil {
+			stats = t.cacheProvider.GetCacheStats()
+		}
+
+		if stats == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "{}")
+			return
+		}
+
+		j, err := json.Marshal(stats)
+		if err != nil {
+			zap.L().Error(err.Error())
+		}
+		fmt.Fprintf(w, string(j))
+
 		return
 	}
 
@@ -109,5 +176,6 @@ func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<p>Hello</p>")
 	fmt.Fprintf(w, "<p>You probably want to make one of the following calls</p>")
 	fmt.Fprintf(w, fmt.Sprintf("<p><a href=\"http:/%s/getdevices\">/getdevices?filter=shelly</a></p>", r.Host))
+	fmt.Fprintf(w, fmt.Sprintf("<p><a href=\"http:/%s/cachestats\">/cachestats</a></p>", r.Host))
 
 }
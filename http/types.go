@@ -1,22 +1,38 @@
 package http
 
 import (
+	"net"
+
 	"github.com/jinzhu/copier"
+	"github.com/miekg/dns"
 
 	"github.com/jodydadescott/home-dns-server/types"
 )
 
 type DomainRecords = types.DomainRecords
+type CacheStats = types.CacheStats
 
 type Config struct {
 	Listener       *NetPort
 	RecordProvider RecordProvider
+	CacheProvider  CacheProvider
+	QueryProvider  QueryProvider
 }
 
 type RecordProvider interface {
 	GetRecords() *DomainRecords
 }
 
+// CacheProvider is optional and provides the cache statistics
+type CacheProvider interface {
+	GetCacheStats() *CacheStats
+}
+
+// QueryProvider is optional and answers DNS over HTTPS queries on /dns-query
+type QueryProvider interface {
+	Query(r *dns.Msg, localAddr, remoteAddr net.Addr) (*dns.Msg, error)
+}
+
 // Clone return copy
 func (t *Config) Clone() *Config {
 	c := &Config{}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
+	"github.com/hashicorp/go-multierror"
 	logger "github.com/jodydadescott/jody-go-logger"
 	"go.uber.org/zap"
 
@@ -34,9 +37,26 @@ func New(config *Config) *Server {
 	}
 
 	dnsConfig := &dns.Config{
-		Listeners:   config.Listeners,
-		Nameservers: config.Nameservers,
-		Trace:       trace,
+		Listeners:    config.Listeners,
+		Nameservers:  config.Nameservers,
+		SOA:          config.SOA,
+		RoundRobin:   config.RoundRobin,
+		TTL:          config.TTL,
+		Fallthrough:  config.Fallthrough,
+		ReverseZones: config.ReverseZones,
+		Cache:        config.Cache,
+		Upstream:     config.Upstream,
+		Forwarders:   config.Forwarders,
+		Blocklist:    config.Blocklist,
+		RPZ:          config.RPZ,
+		ClientGroups: config.ClientGroups,
+		Access:       config.Access,
+
+		PublicReverseZones: config.PublicReverseZones,
+		FallthroughTypes:   config.FallthroughTypes,
+		ShutdownTimeout:    config.ShutdownTimeout,
+		EDNSBufferSize:     config.EDNSBufferSize,
+		Trace:              trace,
 	}
 
 	if config.Unifi != nil && config.Unifi.Enabled {
@@ -55,6 +75,29 @@ func New(config *Config) *Server {
 		zap.L().Debug("static config is not enabled")
 	}
 
+	for _, view := range config.Views {
+
+		viewConfig := &dns.ViewConfig{
+			Name:      view.Name,
+			CIDRs:     view.CIDRs,
+			Listeners: view.Listeners,
+		}
+
+		if view.Unifi != nil && view.Unifi.Enabled {
+			zap.L().Debug(fmt.Sprintf("Unifi is enabled for view %s", view.Name))
+			viewConfig.AddProvider(unifi.New(view.Unifi))
+		}
+
+		if view.Static != nil && view.Static.Enabled {
+			zap.L().Debug(fmt.Sprintf("static config is enabled for view %s", view.Name))
+			for _, v := range static.New(view.Static) {
+				viewConfig.AddProvider(v)
+			}
+		}
+
+		dnsConfig.AddViews(viewConfig)
+	}
+
 	s := &Server{
 		dns: dns.New(dnsConfig),
 	}
@@ -65,6 +108,12 @@ func New(config *Config) *Server {
 		httpConfig := &http.Config{
 			Listener:       config.HttpConfig.Listener,
 			RecordProvider: s.dns,
+			CacheProvider:  s.dns,
+		}
+
+		if config.HttpConfig.DoH {
+			zap.L().Debug("DNS over HTTPS is enabled")
+			httpConfig.QueryProvider = s.dns
 		}
 
 		s.http = http.New(httpConfig)
@@ -80,24 +129,25 @@ func (t *Server) Run(ctx context.Context) error {
 
 	errs := make(chan error, 2)
 
-	dnsCtx, dnsCancel := context.WithCancel(ctx)
-	httpCtx, httpCancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	defer func() {
-		dnsCancel()
-		httpCancel()
-	}()
+	var wg sync.WaitGroup
 
+	wg.Add(1)
 	go func() {
-		err := t.dns.Run(dnsCtx)
+		defer wg.Done()
+		err := t.dns.Run(ctx)
 		if err != nil {
 			errs <- err
 		}
 	}()
 
 	if t.http != nil {
+		wg.Add(1)
 		go func() {
-			err := t.http.Run(httpCtx)
+			defer wg.Done()
+			err := t.http.Run(ctx)
 			if err != nil {
 				errs <- err
 			}
@@ -108,12 +158,22 @@ func (t *Server) Run(ctx context.Context) error {
 
 	case err := <-errs:
 		zap.L().Info("Shutting down or error")
-		return err
+		errs <- err
 
 	case <-ctx.Done():
 		zap.L().Info("Shutting down or signal")
 
 	}
 
-	return nil
+	// Wait for the servers to finish shutting down
+	cancel()
+	wg.Wait()
+	close(errs)
+
+	var result *multierror.Error
+	for err := range errs {
+		result = multierror.Append(result, err)
+	}
+
+	return result.ErrorOrNil()
 }
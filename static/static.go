@@ -2,6 +2,7 @@ package static
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jodydadescott/home-dns-server/types"
@@ -58,6 +59,10 @@ func (t *Client) GetRefreshDuration() time.Duration {
 	return 0
 }
 
+func (t *Client) GetTTL() time.Duration {
+	return t.domain.TTL
+}
+
 func (t *Client) GetRecords() (*Records, error) {
 
 	ptrRecordsMap := make(map[string]*PTRrecord)
@@ -78,6 +83,15 @@ func (t *Client) GetRecords() (*Records, error) {
 
 		a.SRC = source + ":static"
 
+		if err := util.ValidateWildcard(a.Hostname); err != nil {
+			return err
+		}
+
+		// A wildcard does not have a single name to point back to
+		if util.IsWildcard(a.Hostname) {
+			return nil
+		}
+
 		arpa, err := util.GetARPA(a.IP)
 		if err != nil {
 			return err
@@ -87,6 +101,7 @@ func (t *Client) GetRecords() (*Records, error) {
 			ARPA:     arpa,
 			Hostname: a.Hostname,
 			Domain:   a.Domain,
+			TTL:      a.TTL,
 			SRC:      source + ":dynamic",
 		}
 
@@ -119,6 +134,10 @@ func (t *Client) GetRecords() (*Records, error) {
 			return nil, fmt.Errorf("CNAME must have TargetHostname")
 		}
 
+		if err := util.ValidateWildcard(r.AliasHostname); err != nil {
+			return nil, err
+		}
+
 		if r.AliasDomain == "" {
 			r.AliasDomain = t.domain.Domain
 		}
@@ -131,6 +150,88 @@ func (t *Client) GetRecords() (*Records, error) {
 
 	}
 
+	for _, r := range t.domain.Records.MxRecords {
+
+		if r.TargetHostname == "" {
+			return nil, fmt.Errorf("MX must have TargetHostname")
+		}
+
+		if r.Domain == "" {
+			r.Domain = t.domain.Domain
+		}
+
+		if r.TargetDomain == "" {
+			r.TargetDomain = t.domain.Domain
+		}
+
+		r.SRC = source + ":static"
+	}
+
+	for _, r := range t.domain.Records.TxtRecords {
+
+		if len(r.Text) <= 0 {
+			return nil, fmt.Errorf("TXT must have Text")
+		}
+
+		for _, s := range r.Text {
+			if len(s) > 255 {
+				return nil, fmt.Errorf("TXT Text entries must not exceed 255 characters")
+			}
+		}
+
+		if r.Domain == "" {
+			r.Domain = t.domain.Domain
+		}
+
+		r.SRC = source + ":static"
+	}
+
+	for _, r := range t.domain.Records.SrvRecords {
+
+		if r.Hostname == "" {
+			return nil, fmt.Errorf("SRV must have Hostname")
+		}
+
+		if !strings.HasPrefix(r.Hostname, "_") {
+			return nil, fmt.Errorf("SRV Hostname %s must be in the form _service._proto", r.Hostname)
+		}
+
+		if r.TargetHostname == "" {
+			return nil, fmt.Errorf("SRV must have TargetHostname")
+		}
+
+		if r.Port == 0 {
+			return nil, fmt.Errorf("SRV must have Port")
+		}
+
+		if r.Domain == "" {
+			r.Domain = t.domain.Domain
+		}
+
+		if r.TargetDomain == "" {
+			r.TargetDomain = t.domain.Domain
+		}
+
+		r.SRC = source + ":static"
+	}
+
+	for _, r := range t.domain.Records.NsRecords {
+
+		if r.TargetHostname == "" {
+			return nil, fmt.Errorf("NS must have TargetHostname")
+		}
+
+		if r.Domain == "" {
+			r.Domain = t.domain.Domain
+		}
+
+		if r.TargetDomain == "" {
+			r.TargetDomain = t.domain.Domain
+		}
+
+		r.SRC = source + ":static"
+	}
+
 	for _, p := range t.domain.Records.PtrRecords {
 		existing := ptrRecordsMap[p.GetKey()]
 		if existing == nil {
@@ -0,0 +1,40 @@
+package action
+
+import (
+	"strings"
+)
+
+// Action is how a blocked name is answered. NXDomain answers that the name does
+// not exist, Zero answers with 0.0.0.0 or :: and Sinkhole answers with the
+// configured sinkhole addresses.
+type Action string
+
+const (
+	Empty    Action = ""
+	NXDomain Action = "nxdomain"
+	Zero     Action = "zero"
+	Sinkhole Action = "sinkhole"
+	Invalid  Action = "INVALID"
+)
+
+// NewFromString returns enum value from string
+func NewFromString(input string) Action {
+
+	switch strings.ToLower(input) {
+
+	case string(NXDomain):
+		return NXDomain
+
+	case string(Zero):
+		return Zero
+
+	case string(Sinkhole):
+		return Sinkhole
+
+	case "":
+		return Empty
+
+	}
+
+	return Invalid
+}
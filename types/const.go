@@ -3,7 +3,10 @@ package types
 import (
 	"time"
 
+	"github.com/jodydadescott/home-dns-server/types/action"
+	"github.com/jodydadescott/home-dns-server/types/listformat"
 	"github.com/jodydadescott/home-dns-server/types/proto"
+	"github.com/jodydadescott/home-dns-server/types/strategy"
 )
 
 const (
@@ -11,7 +14,40 @@ const (
 	DefaultDomain    = "home"
 	DefaultDnsProto  = proto.UDP
 	DefaultDnsPort   = 53
+	DefaultDoTPort   = 853
 	DefaultDnsDomain = "home"
 	DefaultRefresh   = time.Hour
 	DefaultHTTPPort  = 8080
+	DefaultTTL       = time.Hour
+
+	DefaultShutdownTimeout = time.Second * 5
+	DefaultEDNSBufferSize  = 1232
+	DefaultSOAMname        = "ns"
+	DefaultSOARname        = "hostmaster"
+	DefaultSOARefresh      = time.Hour
+	DefaultSOARetry        = time.Minute * 10
+	DefaultSOAExpire       = time.Hour * 24
+	DefaultSOAMinttl       = time.Minute * 5
+
+	DefaultCacheMaxEntries     = 10000
+	DefaultCacheMaxTTL         = time.Hour * 24
+	DefaultCacheMaxNegativeTTL = time.Hour * 3
+	DefaultCacheStaleTTL       = time.Hour * 24
+	DefaultCacheStaleAnswerTTL = time.Second * 30
+	DefaultPrefetchHits        = 2
+	DefaultPrefetchPercentage  = 10
+
+	DefaultUpstreamStrategy      = strategy.Sequential
+	DefaultUpstreamTimeout       = time.Second * 2
+	DefaultUpstreamMaxFailures   = 3
+	DefaultUpstreamIdleConns     = 4
+	DefaultUpstreamRetryInterval = time.Second * 30
+	DefaultDoHKeepalive          = time.Second * 30
+	DefaultHealthCheckName       = "."
+
+	DefaultBlocklistAction  = action.Zero
+	DefaultBlocklistFormat  = listformat.Hosts
+	DefaultBlocklistTTL     = time.Second * 2
+	DefaultBlocklistRefresh = time.Hour * 24
+	DefaultBlocklistTimeout = time.Second * 30
 )
@@ -1,7 +1,12 @@
 package types
 
 import (
+	"time"
+
+	"github.com/jodydadescott/home-dns-server/types/action"
+	"github.com/jodydadescott/home-dns-server/types/listformat"
 	"github.com/jodydadescott/home-dns-server/types/proto"
+	"github.com/jodydadescott/home-dns-server/types/strategy"
 	logger "github.com/jodydadescott/jody-go-logger"
 )
 
@@ -21,6 +26,11 @@ func NewExampleConfig() *Config {
 		IP:       "192.168.1.2",
 	})
 
+	d.Records.AddARecords(&ARecord{
+		Hostname: "*.apps",
+		IP:       "192.168.1.3",
+	})
+
 	d.Records.AddAAAARecords(&ARecord{
 		Hostname: "a_record_1",
 		IP:       "2001:db8:3333:4444:5555:6666:7777:8888",
@@ -38,8 +48,35 @@ func NewExampleConfig() *Config {
 		TargetDomain:   DefaultDomain,
 	})
 
+	d.Records.AddMXRecords(&MXRecord{
+		Preference:     10,
+		TargetHostname: "a_record_1",
+	})
+
+	d.Records.AddTXTRecords(&TXTRecord{
+		Hostname: "_acme-challenge",
+		Text:     []string{"verification-token"},
+	})
+
+	d.Records.AddSRVRecords(&SRVRecord{
+		Hostname:       "_ldap._tcp",
+		Priority:       10,
+		Weight:         5,
+		Port:           389,
+		TargetHostname: "a_record_2",
+	})
+
+	internal := &Domain{
+		Domain: "example.net",
+	}
+
+	internal.Records.AddARecords(&ARecord{
+		Hostname: "www",
+		IP:       "192.168.1.10",
+	})
+
 	static := &StaticConfig{Enabled: true}
-	static.AddDomains(d)
+	static.AddDomains(d, internal)
 
 	unifiConfig := &UnifiConfig{}
 	unifiConfig.Hostname = "https://10.0.1.1"
@@ -69,9 +106,30 @@ func NewExampleConfig() *Config {
 		Logging: &Logger{
 			LogLevel: logger.DebugLevel,
 		},
+		SOA: &SOAConfig{
+			Mname: DefaultSOAMname,
+			Rname: DefaultSOARname,
+		},
+		Cache: &CacheConfig{
+			Enabled:    true,
+			MaxEntries: DefaultCacheMaxEntries,
+			ServeStale: true,
+			Prefetch:   true,
+		},
+		Upstream: &UpstreamConfig{
+			Strategy:            strategy.Fastest,
+			HealthCheckInterval: time.Second * 30,
+		},
 	}
 
-	c.AddListeners(listener1, listener2)
+	listener3 := &NetPort{
+		Port:     DefaultDoTPort,
+		Proto:    proto.TLS,
+		CertFile: "/etc/home-dns-server/tls.crt",
+		KeyFile:  "/etc/home-dns-server/tls.key",
+	}
+
+	c.AddListeners(listener1, listener2, listener3)
 
 	c.AddNameservers(&NetPort{
 		IP:    "8.8.8.8",
@@ -91,8 +149,133 @@ func NewExampleConfig() *Config {
 		Proto: proto.TCP,
 	})
 
+	c.AddNameservers(&NetPort{
+		IP:         "1.0.0.1",
+		Port:       DefaultDoTPort,
+		Proto:      proto.TLS,
+		ServerName: "cloudflare-dns.com",
+	})
+
+	c.AddNameservers(&NetPort{
+		IP:    "1.1.1.1",
+		Proto: proto.HTTPS,
+		URL:   "https://cloudflare-dns.com/dns-query",
+	})
+
+	consul := &ForwarderConfig{
+		Domain: "consul",
+	}
+
+	consul.AddNameservers(&NetPort{
+		IP:    "127.0.0.1",
+		Port:  8600,
+		Proto: proto.UDP,
+	})
+
+	c.AddForwarders(consul)
+
+	blocklist := &BlocklistConfig{
+		Enabled: true,
+		Action:  action.Zero,
+	}
+
+	blocklist.AddLists(&BlocklistSource{
+		Name:    "stevenblack",
+		Enabled: true,
+		URL:     "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts",
+		Format:  listformat.Hosts,
+	}, &BlocklistSource{
+		Name:    "local",
+		Enabled: true,
+		Path:    "/etc/home-dns-server/blocklist.txt",
+		Format:  listformat.Domains,
+	})
+
+	blocklist.AddAllowlist("s.youtube.com")
+
+	c.Blocklist = blocklist
+
+	rpz := &RPZConfig{
+		Enabled: true,
+		Refresh: time.Hour,
+	}
+
+	rpz.AddZones(&RPZZoneConfig{
+		Name:    "local",
+		Enabled: true,
+		Path:    "/etc/home-dns-server/rpz.local.zone",
+		Zone:    "rpz.local",
+	})
+
+	c.RPZ = rpz
+
+	kids := &ClientGroupConfig{
+		Name: "kids",
+		MACs: []string{"00:11:22:33:44:55"},
+		Blocklist: &BlocklistConfig{
+			Enabled: true,
+			Action:  action.NXDomain,
+		},
+	}
+
+	kids.Blocklist.AddLists(&BlocklistSource{
+		Name:    "stevenblack-family",
+		Enabled: true,
+		URL:     "https://raw.githubusercontent.com/StevenBlack/hosts/master/alternates/porn-social/hosts",
+		Format:  listformat.Hosts,
+	})
+
+	kids.AddNameservers(&NetPort{
+		IP:    "1.1.1.3",
+		Port:  53,
+		Proto: proto.UDP,
+	})
+
+	iot := &ClientGroupConfig{
+		Name:              "iot",
+		CIDRs:             []string{"192.168.20.0/24"},
+		DisableForwarding: true,
+		LocalDomains:      []string{"home"},
+	}
+
+	c.AddClientGroups(kids, iot)
+
+	public := &Domain{
+		Domain: "example.net",
+	}
+
+	public.Records.AddARecords(&ARecord{
+		Hostname: "www",
+		IP:       "203.0.113.10",
+	})
+
+	vpn := &ViewConfig{
+		Name:  "vpn",
+		CIDRs: []string{"10.8.0.0/24"},
+		Static: &StaticConfig{
+			Enabled: true,
+		},
+	}
+
+	vpn.Static.AddDomains(public)
+
+	c.AddViews(vpn)
+
+	c.Access = &AccessConfig{
+		Recursion: &ACLConfig{
+			Allow: []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "::1", "fc00::/7"},
+		},
+	}
+
+	listener3.Access = &AccessConfig{
+		Local: &ACLConfig{
+			Deny: []string{"192.168.20.0/24"},
+		},
+	}
+
 	c.HttpConfig = &HttpConfig{
 		Enabled: true,
+		DoH:     true,
 		Listener: &NetPort{
 			Port: 8080,
 		},
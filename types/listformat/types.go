@@ -0,0 +1,40 @@
+package listformat
+
+import (
+	"strings"
+)
+
+// Format is the format of a blocklist. Hosts is a hosts file where each name is
+// mapped to an address such as 0.0.0.0, Domains is one name per line and AdBlock
+// is the ||example.com^ rule syntax where subdomains are also blocked.
+type Format string
+
+const (
+	Empty   Format = ""
+	Hosts   Format = "hosts"
+	Domains Format = "domains"
+	AdBlock Format = "adblock"
+	Invalid Format = "INVALID"
+)
+
+// NewFromString returns enum value from string
+func NewFromString(input string) Format {
+
+	switch strings.ToLower(input) {
+
+	case string(Hosts):
+		return Hosts
+
+	case string(Domains):
+		return Domains
+
+	case string(AdBlock):
+		return AdBlock
+
+	case "":
+		return Empty
+
+	}
+
+	return Invalid
+}
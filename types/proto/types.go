@@ -4,13 +4,16 @@ import (
 	"strings"
 )
 
-// Proto is the protocol type. Currently only UDP and TCP are supported.
+// Proto is the protocol type. TLS is DNS over TLS (RFC 7858) and HTTPS is DNS
+// over HTTPS (RFC 8484).
 type Proto string
 
 const (
 	Empty   Proto = ""
 	UDP     Proto = "udp"
 	TCP     Proto = "tcp"
+	TLS     Proto = "tls"
+	HTTPS   Proto = "https"
 	Invalid Proto = "INVALID"
 )
 
@@ -25,6 +28,12 @@ func NewFromString(input string) Proto {
 	case string(TCP):
 		return TCP
 
+	case string(TLS):
+		return TLS
+
+	case string(HTTPS):
+		return HTTPS
+
 	case "":
 		return Empty
 
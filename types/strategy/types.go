@@ -0,0 +1,46 @@
+package strategy
+
+import (
+	"strings"
+)
+
+// Strategy is the order in which upstream nameservers are tried
+type Strategy string
+
+const (
+	Empty      Strategy = ""
+	Sequential Strategy = "sequential"
+	Random     Strategy = "random"
+	RoundRobin Strategy = "roundrobin"
+	Fastest    Strategy = "fastest"
+	Parallel   Strategy = "parallel"
+	Invalid    Strategy = "INVALID"
+)
+
+// NewFromString returns enum value from string
+func NewFromString(input string) Strategy {
+
+	switch strings.ToLower(input) {
+
+	case string(Sequential):
+		return Sequential
+
+	case string(Random):
+		return Random
+
+	case string(RoundRobin):
+		return RoundRobin
+
+	case string(Fastest):
+		return Fastest
+
+	case string(Parallel):
+		return Parallel
+
+	case "":
+		return Empty
+
+	}
+
+	return Invalid
+}
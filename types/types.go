@@ -9,7 +9,10 @@ import (
 	logger "github.com/jodydadescott/jody-go-logger"
 	"github.com/jodydadescott/unifi-go-sdk"
 
+	"github.com/jodydadescott/home-dns-server/types/action"
+	"github.com/jodydadescott/home-dns-server/types/listformat"
 	"github.com/jodydadescott/home-dns-server/types/proto"
+	"github.com/jodydadescott/home-dns-server/types/strategy"
 )
 
 type Logger = logger.Config
@@ -20,6 +23,31 @@ type NetPort struct {
 	Port        int         `json:"port,omitempty" yaml:"port,omitempty"`
 	Proto       proto.Proto `json:"proto,omitempty" yaml:"proto,omitempty"`
 	ipColonPort string      `json:"-"`
+
+	// ServerName is the name used to verify the certificate of a TLS or HTTPS
+	// nameserver. If not set the IP or the host in the URL is verified.
+	ServerName string `json:"serverName,omitempty" yaml:"serverName,omitempty"`
+
+	// CAFile is a PEM bundle used instead of the system roots to verify the
+	// certificate of a TLS or HTTPS nameserver
+	CAFile string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+
+	// URL is the endpoint of a HTTPS nameserver such as
+	// https://cloudflare-dns.com/dns-query. If IP is set it is connected to
+	// instead of resolving the host in the URL.
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+
+	// Method is GET or POST for a HTTPS nameserver. The default is POST.
+	Method string `json:"method,omitempty" yaml:"method,omitempty"`
+
+	// CertFile and KeyFile are the PEM certificate and key of a TLS listener.
+	// They are reloaded when the files change.
+	CertFile string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+
+	// Access restricts the clients of a DNS listener in addition to the global
+	// access rules
+	Access *AccessConfig `json:"access,omitempty" yaml:"access,omitempty"`
 }
 
 // Clone return copy
@@ -39,6 +67,16 @@ func (t *NetPort) SetProtoUDP() {
 	t.Proto = proto.UDP
 }
 
+// SetProtoTLS sets proto type to TLS
+func (t *NetPort) SetProtoTLS() {
+	t.Proto = proto.TLS
+}
+
+// SetProtoHTTPS sets proto type to HTTPS
+func (t *NetPort) SetProtoHTTPS() {
+	t.Proto = proto.HTTPS
+}
+
 // GetIPColonPort returns the IP + colong + port as a string
 func (t *NetPort) GetIPColonPort() string {
 	if t.ipColonPort == "" {
@@ -49,11 +87,16 @@ func (t *NetPort) GetIPColonPort() string {
 
 // ARecord is a DNS A Record
 type ARecord struct {
-	Domain   string `json:"domain,omitempty" yaml:"domain,omitempty"`
-	Hostname string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
-	IP       string `json:"ip,omitempty" yaml:"ip,omitempty"`
-	SRC      string `json:"src,omitempty" yaml:"src,omitempty"`
-	fqdn     string `json:"-"`
+	Domain   string        `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Hostname string        `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	IP       string        `json:"ip,omitempty" yaml:"ip,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	SRC      string        `json:"src,omitempty" yaml:"src,omitempty"`
+	fqdn     string        `json:"-"`
+
+	// MAC is the hardware address of the host if it is known. It is used to
+	// match the host to a client group.
+	MAC string `json:"mac,omitempty" yaml:"mac,omitempty"`
 }
 
 // Clone return copy
@@ -78,13 +121,14 @@ func (t *ARecord) GetValue() string {
 
 // CNameRecord is a DNS CNAME Record
 type CNameRecord struct {
-	AliasHostname  string `json:"aliasHostname,omitempty" yaml:"aliasHostname,omitempty"`
-	AliasDomain    string `json:"aliasDomain,omitempty" yaml:"aliasDomain,omitempty"`
-	TargetHostname string `json:"targetHostname,omitempty" yaml:"targetHostname,omitempty"`
-	TargetDomain   string `json:"targetDomain,omitempty" yaml:"targetDomain,omitempty"`
-	SRC            string `json:"src,omitempty" yaml:"src,omitempty"`
-	fqdnAlias      string `json:"-"`
-	fqdnTarget     string `json:"-"`
+	AliasHostname  string        `json:"aliasHostname,omitempty" yaml:"aliasHostname,omitempty"`
+	AliasDomain    string        `json:"aliasDomain,omitempty" yaml:"aliasDomain,omitempty"`
+	TargetHostname string        `json:"targetHostname,omitempty" yaml:"targetHostname,omitempty"`
+	TargetDomain   string        `json:"targetDomain,omitempty" yaml:"targetDomain,omitempty"`
+	TTL            time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	SRC            string        `json:"src,omitempty" yaml:"src,omitempty"`
+	fqdnAlias      string        `json:"-"`
+	fqdnTarget     string        `json:"-"`
 }
 
 // Clone return copy
@@ -112,11 +156,12 @@ func (t *CNameRecord) GetValue() string {
 
 // PTRrecord is a DNS PTR Record
 type PTRrecord struct {
-	ARPA     string `json:"arpa,omitempty" yaml:"arpa,omitempty"`
-	Hostname string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
-	Domain   string `json:"domain,omitempty" yaml:"domain,omitempty"`
-	SRC      string `json:"src,omitempty" yaml:"src,omitempty"`
-	fqdn     string `json:"-"`
+	ARPA     string        `json:"arpa,omitempty" yaml:"arpa,omitempty"`
+	Hostname string        `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Domain   string        `json:"domain,omitempty" yaml:"domain,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	SRC      string        `json:"src,omitempty" yaml:"src,omitempty"`
+	fqdn     string        `json:"-"`
 }
 
 // Clone return copy
@@ -139,21 +184,544 @@ func (t *PTRrecord) GetValue() string {
 	return t.fqdn
 }
 
+// MXRecord is a DNS MX Record. If the Hostname is empty or @ the record
+// is for the domain itself.
+type MXRecord struct {
+	Hostname       string        `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Domain         string        `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Preference     uint16        `json:"preference,omitempty" yaml:"preference,omitempty"`
+	TargetHostname string        `json:"targetHostname,omitempty" yaml:"targetHostname,omitempty"`
+	TargetDomain   string        `json:"targetDomain,omitempty" yaml:"targetDomain,omitempty"`
+	TTL            time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	SRC            string        `json:"src,omitempty" yaml:"src,omitempty"`
+	fqdn           string        `json:"-"`
+	fqdnTarget     string        `json:"-"`
+}
+
+// Clone return copy
+func (t *MXRecord) Clone() *MXRecord {
+	c := &MXRecord{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// GetKey returns the key for the record type
+func (t *MXRecord) GetKey() string {
+	if t.fqdn == "" {
+		t.fqdn = getFQDN(t.Hostname, t.Domain)
+	}
+	return t.fqdn
+}
+
+// GetValue returns the value for the record type
+func (t *MXRecord) GetValue() string {
+	if t.fqdnTarget == "" {
+		t.fqdnTarget = getFQDN(t.TargetHostname, t.TargetDomain)
+	}
+	return t.fqdnTarget
+}
+
+// TXTRecord is a DNS TXT Record. If the Hostname is empty or @ the record
+// is for the domain itself. Each entry in Text is a character string.
+type TXTRecord struct {
+	Hostname string        `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Domain   string        `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Text     []string      `json:"text,omitempty" yaml:"text,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	SRC      string        `json:"src,omitempty" yaml:"src,omitempty"`
+	fqdn     string        `json:"-"`
+}
+
+// Clone return copy
+func (t *TXTRecord) Clone() *TXTRecord {
+	c := &TXTRecord{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// GetKey returns the key for the record type
+func (t *TXTRecord) GetKey() string {
+	if t.fqdn == "" {
+		t.fqdn = getFQDN(t.Hostname, t.Domain)
+	}
+	return t.fqdn
+}
+
+// GetValue returns the value for the record type
+func (t *TXTRecord) GetValue() []string {
+	return t.Text
+}
+
+// SRVRecord is a DNS SRV Record. The Hostname is the service and protocol
+// such as _ldap._tcp
+type SRVRecord struct {
+	Hostname       string        `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Domain         string        `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Priority       uint16        `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Weight         uint16        `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Port           uint16        `json:"port,omitempty" yaml:"port,omitempty"`
+	TargetHostname string        `json:"targetHostname,omitempty" yaml:"targetHostname,omitempty"`
+	TargetDomain   string        `json:"targetDomain,omitempty" yaml:"targetDomain,omitempty"`
+	TTL            time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	SRC            string        `json:"src,omitempty" yaml:"src,omitempty"`
+	fqdn           string        `json:"-"`
+	fqdnTarget     string        `json:"-"`
+}
+
+// Clone return copy
+func (t *SRVRecord) Clone() *SRVRecord {
+	c := &SRVRecord{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// GetKey returns the key for the record type
+func (t *SRVRecord) GetKey() string {
+	if t.fqdn == "" {
+		t.fqdn = getFQDN(t.Hostname, t.Domain)
+	}
+	return t.fqdn
+}
+
+// GetValue returns the value for the record type
+func (t *SRVRecord) GetValue() string {
+	if t.fqdnTarget == "" {
+		t.fqdnTarget = getFQDN(t.TargetHostname, t.TargetDomain)
+	}
+	return t.fqdnTarget
+}
+
+// NSRecord is a DNS NS Record. If the Hostname is empty or @ the record
+// is for the domain itself, otherwise it is a delegation.
+type NSRecord struct {
+	Hostname       string        `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Domain         string        `json:"domain,omitempty" yaml:"domain,omitempty"`
+	TargetHostname string        `json:"targetHostname,omitempty" yaml:"targetHostname,omitempty"`
+	TargetDomain   string        `json:"targetDomain,omitempty" yaml:"targetDomain,omitempty"`
+	TTL            time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	SRC            string        `json:"src,omitempty" yaml:"src,omitempty"`
+	fqdn           string        `json:"-"`
+	fqdnTarget     string        `json:"-"`
+}
+
+// Clone return copy
+func (t *NSRecord) Clone() *NSRecord {
+	c := &NSRecord{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// GetKey returns the key for the record type
+func (t *NSRecord) GetKey() string {
+	if t.fqdn == "" {
+		t.fqdn = getFQDN(t.Hostname, t.Domain)
+	}
+	return t.fqdn
+}
+
+// GetValue returns the value for the record type
+func (t *NSRecord) GetValue() string {
+	if t.fqdnTarget == "" {
+		t.fqdnTarget = getFQDN(t.TargetHostname, t.TargetDomain)
+	}
+	return t.fqdnTarget
+}
+
+// getFQDN returns the fully qualified name for the hostname and domain. An empty
+// hostname or @ refers to the domain itself.
+func getFQDN(hostname, domain string) string {
+	if hostname == "" || hostname == "@" {
+		return domain + "."
+	}
+	return hostname + "." + domain + "."
+}
+
 // Config is the main user level config
 type Config struct {
-	Notes       string        `json:"notes,omitempty" yaml:"notes,omitempty"`
-	Unifi       *UnifiConfig  `json:"unifiConfig,omitempty" yaml:"unifiConfig,omitempty"`
-	Listeners   []*NetPort    `json:"listeners,omitempty" yaml:"listeners,omitempty"`
-	Static      *StaticConfig `json:"static,omitempty" yaml:"static,omitempty"`
-	Nameservers []*NetPort    `json:"nameservers,omitempty" yaml:"nameservers,omitempty"`
-	Logging     *Logger       `json:"logging,omitempty" yaml:"logging,omitempty"`
-	HttpConfig  *HttpConfig   `json:"httpConfig,omitempty" yaml:"httpConfig,omitempty"`
+	Notes        string               `json:"notes,omitempty" yaml:"notes,omitempty"`
+	Unifi        *UnifiConfig         `json:"unifiConfig,omitempty" yaml:"unifiConfig,omitempty"`
+	Listeners    []*NetPort           `json:"listeners,omitempty" yaml:"listeners,omitempty"`
+	Static       *StaticConfig        `json:"static,omitempty" yaml:"static,omitempty"`
+	Nameservers  []*NetPort           `json:"nameservers,omitempty" yaml:"nameservers,omitempty"`
+	Logging      *Logger              `json:"logging,omitempty" yaml:"logging,omitempty"`
+	HttpConfig   *HttpConfig          `json:"httpConfig,omitempty" yaml:"httpConfig,omitempty"`
+	SOA          *SOAConfig           `json:"soa,omitempty" yaml:"soa,omitempty"`
+	RoundRobin   bool                 `json:"roundRobin,omitempty" yaml:"roundRobin,omitempty"`
+	TTL          time.Duration        `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	Fallthrough  []string             `json:"fallthrough,omitempty" yaml:"fallthrough,omitempty"`
+	ReverseZones []string             `json:"reverseZones,omitempty" yaml:"reverseZones,omitempty"`
+	Cache        *CacheConfig         `json:"cache,omitempty" yaml:"cache,omitempty"`
+	Upstream     *UpstreamConfig      `json:"upstream,omitempty" yaml:"upstream,omitempty"`
+	Forwarders   []*ForwarderConfig   `json:"forwarders,omitempty" yaml:"forwarders,omitempty"`
+	Blocklist    *BlocklistConfig     `json:"blocklist,omitempty" yaml:"blocklist,omitempty"`
+	RPZ          *RPZConfig           `json:"rpz,omitempty" yaml:"rpz,omitempty"`
+	ClientGroups []*ClientGroupConfig `json:"clientGroups,omitempty" yaml:"clientGroups,omitempty"`
+	Views        []*ViewConfig        `json:"views,omitempty" yaml:"views,omitempty"`
+	Access       *AccessConfig        `json:"access,omitempty" yaml:"access,omitempty"`
+
+	// ShutdownTimeout is how long in flight queries are given to complete on shutdown
+	ShutdownTimeout time.Duration `json:"shutdownTimeout,omitempty" yaml:"shutdownTimeout,omitempty"`
+
+	// EDNSBufferSize is the largest UDP response sent to clients and the size
+	// advertised to nameservers
+	EDNSBufferSize uint16 `json:"ednsBufferSize,omitempty" yaml:"ednsBufferSize,omitempty"`
+
+	// PublicReverseZones derives reverse zones from PTR records with public IPv4
+	// addresses as well as private ones. The zone is the whole /24 so the other
+	// names in it are answered locally instead of being forwarded. Zones for
+	// IPv6 addresses, which are the /64 of the address, are always derived.
+	PublicReverseZones bool `json:"publicReverseZones,omitempty" yaml:"publicReverseZones,omitempty"`
+
+	// FallthroughTypes are the query types such as TXT or SRV that are forwarded
+	// for the Fallthrough domains when there is no local answer. If empty every
+	// type falls through.
+	FallthroughTypes []string `json:"fallthroughTypes,omitempty" yaml:"fallthroughTypes,omitempty"`
+}
+
+// CacheConfig is the config for the cache of forwarded responses. MinTTL and
+// MaxTTL bound how long positive answers are kept. Negative answers are kept for
+// the SOA minimum but never longer than MaxNegativeTTL. When MaxEntries is
+// reached the least recently used entry is evicted.
+//
+// If ServeStale is true expired answers are kept for StaleTTL and returned with
+// a TTL of StaleAnswerTTL when the nameservers fail (RFC 8767). If Prefetch is
+// true an answer that has been returned at least PrefetchHits times is refreshed
+// in the background once PrefetchPercentage of its TTL remains.
+type CacheConfig struct {
+	Enabled        bool          `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	MaxEntries     int           `json:"maxEntries,omitempty" yaml:"maxEntries,omitempty"`
+	MinTTL         time.Duration `json:"minTTL,omitempty" yaml:"minTTL,omitempty"`
+	MaxTTL         time.Duration `json:"maxTTL,omitempty" yaml:"maxTTL,omitempty"`
+	MaxNegativeTTL time.Duration `json:"maxNegativeTTL,omitempty" yaml:"maxNegativeTTL,omitempty"`
+
+	ServeStale     bool          `json:"serveStale,omitempty" yaml:"serveStale,omitempty"`
+	StaleTTL       time.Duration `json:"staleTTL,omitempty" yaml:"staleTTL,omitempty"`
+	StaleAnswerTTL time.Duration `json:"staleAnswerTTL,omitempty" yaml:"staleAnswerTTL,omitempty"`
+
+	Prefetch           bool `json:"prefetch,omitempty" yaml:"prefetch,omitempty"`
+	PrefetchHits       int  `json:"prefetchHits,omitempty" yaml:"prefetchHits,omitempty"`
+	PrefetchPercentage int  `json:"prefetchPercentage,omitempty" yaml:"prefetchPercentage,omitempty"`
 }
 
-// HttpConfig is the config for HTTP servers
+// Clone return copy
+func (t *CacheConfig) Clone() *CacheConfig {
+	c := &CacheConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// UpstreamConfig is the config for how the nameservers are selected and health
+// checked. A nameserver is marked down after MaxFailures consecutive failures and
+// is skipped until it is up again. If HealthCheckInterval is set a nameserver is
+// up again when a health check succeeds. Otherwise a query is sent to it every
+// RetryInterval and it is up again when one succeeds. If every nameserver is
+// down they are all tried.
+type UpstreamConfig struct {
+	Strategy            strategy.Strategy `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+	Timeout             time.Duration     `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	MaxFailures         int               `json:"maxFailures,omitempty" yaml:"maxFailures,omitempty"`
+	HealthCheckInterval time.Duration     `json:"healthCheckInterval,omitempty" yaml:"healthCheckInterval,omitempty"`
+	HealthCheckName     string            `json:"healthCheckName,omitempty" yaml:"healthCheckName,omitempty"`
+	RetryInterval       time.Duration     `json:"retryInterval,omitempty" yaml:"retryInterval,omitempty"`
+}
+
+// Clone return copy
+func (t *UpstreamConfig) Clone() *UpstreamConfig {
+	c := &UpstreamConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// ForwarderConfig is a domain that is forwarded to its own nameservers instead of
+// the global nameservers. If Upstream is not set the global Upstream is used.
+type ForwarderConfig struct {
+	Domain      string          `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Nameservers []*NetPort      `json:"nameservers,omitempty" yaml:"nameservers,omitempty"`
+	Upstream    *UpstreamConfig `json:"upstream,omitempty" yaml:"upstream,omitempty"`
+}
+
+// Clone return copy
+func (t *ForwarderConfig) Clone() *ForwarderConfig {
+	c := &ForwarderConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// AddNameservers adds the specified nameservers to the forwarder
+func (t *ForwarderConfig) AddNameservers(nameservers ...*NetPort) *ForwarderConfig {
+	for _, v := range nameservers {
+		t.Nameservers = append(t.Nameservers, v)
+	}
+	return t
+}
+
+// BlocklistConfig is the config for blocking ad and tracker names before they are
+// forwarded. The enabled lists are loaded on start and every Refresh. A list that
+// fails to load keeps its previous names. Names in the Allowlist and their
+// subdomains are never blocked.
+//
+// Blocked names are answered according to Action with a TTL of TTL. For the
+// sinkhole action A and AAAA queries are answered with SinkholeIPv4 and
+// SinkholeIPv6, the answer is empty if the address for the type is not set.
+type BlocklistConfig struct {
+	Enabled      bool               `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Lists        []*BlocklistSource `json:"lists,omitempty" yaml:"lists,omitempty"`
+	Allowlist    []string           `json:"allowlist,omitempty" yaml:"allowlist,omitempty"`
+	Action       action.Action      `json:"action,omitempty" yaml:"action,omitempty"`
+	SinkholeIPv4 string             `json:"sinkholeIPv4,omitempty" yaml:"sinkholeIPv4,omitempty"`
+	SinkholeIPv6 string             `json:"sinkholeIPv6,omitempty" yaml:"sinkholeIPv6,omitempty"`
+	TTL          time.Duration      `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	Refresh      time.Duration      `json:"refresh,omitempty" yaml:"refresh,omitempty"`
+}
+
+// Clone return copy
+func (t *BlocklistConfig) Clone() *BlocklistConfig {
+	c := &BlocklistConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// AddLists adds the specified lists to the blocklist
+func (t *BlocklistConfig) AddLists(lists ...*BlocklistSource) *BlocklistConfig {
+	for _, v := range lists {
+		t.Lists = append(t.Lists, v)
+	}
+	return t
+}
+
+// AddAllowlist adds the specified names to the allowlist
+func (t *BlocklistConfig) AddAllowlist(names ...string) *BlocklistConfig {
+	for _, v := range names {
+		t.Allowlist = append(t.Allowlist, v)
+	}
+	return t
+}
+
+// BlocklistSource is a list of names to block that is read from Path or
+// downloaded from URL. Only one of them may be set. A list is only loaded if
+// Enabled is true.
+type BlocklistSource struct {
+	Name    string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Enabled bool              `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Path    string            `json:"path,omitempty" yaml:"path,omitempty"`
+	URL     string            `json:"url,omitempty" yaml:"url,omitempty"`
+	Format  listformat.Format `json:"format,omitempty" yaml:"format,omitempty"`
+}
+
+// Clone return copy
+func (t *BlocklistSource) Clone() *BlocklistSource {
+	c := &BlocklistSource{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// GetName returns the name or if not set the path or URL
+func (t *BlocklistSource) GetName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	if t.Path != "" {
+		return t.Path
+	}
+	return t.URL
+}
+
+// RPZConfig is the config for Response Policy Zones. The policies of the enabled
+// zones are applied to local and forwarded answers. When more than one zone has
+// a policy for a query the zone listed first is used. The zones are reloaded
+// every Refresh, if it is not set they are only loaded on start.
+type RPZConfig struct {
+	Enabled bool             `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Zones   []*RPZZoneConfig `json:"zones,omitempty" yaml:"zones,omitempty"`
+	Refresh time.Duration    `json:"refresh,omitempty" yaml:"refresh,omitempty"`
+}
+
+// Clone return copy
+func (t *RPZConfig) Clone() *RPZConfig {
+	c := &RPZConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// AddZones adds the specified zones to the config
+func (t *RPZConfig) AddZones(zones ...*RPZZoneConfig) *RPZConfig {
+	for _, v := range zones {
+		t.Zones = append(t.Zones, v)
+	}
+	return t
+}
+
+// RPZZoneConfig is a policy zone read from the zone file at Path. Zone is the
+// origin of the file, if not set the owner of the SOA record is used.
+type RPZZoneConfig struct {
+	Name    string `json:"name,omitempty" yaml:"name,omitempty"`
+	Enabled bool   `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Path    string `json:"path,omitempty" yaml:"path,omitempty"`
+	Zone    string `json:"zone,omitempty" yaml:"zone,omitempty"`
+}
+
+// Clone return copy
+func (t *RPZZoneConfig) Clone() *RPZZoneConfig {
+	c := &RPZZoneConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// GetName returns the name or if not set the zone or path
+func (t *RPZZoneConfig) GetName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	if t.Zone != "" {
+		return t.Zone
+	}
+	return t.Path
+}
+
+// ClientGroupConfig is a group of clients with their own policy. A client is in
+// the first group where its IP is in CIDRs or IPs or its MAC is in MACs. MACs
+// are matched using the MAC of the A and AAAA records from the providers, such
+// as Unifi. Clients that are not in a group use the global config.
+//
+// If Blocklist is set it is used instead of the global blocklist, if it is not
+// enabled names are not blocked for the group. If Nameservers is set names that
+// are not local are forwarded to them instead of the global nameservers using
+// Upstream, conditional forwarders are used by every group. If
+// DisableForwarding is true only local names are answered. If LocalDomains is
+// set only local names in these domains are answered, reverse zones must be
+// listed to be answered, such as in-addr.arpa. Queries that are not allowed
+// are REFUSED.
+type ClientGroupConfig struct {
+	Name              string           `json:"name,omitempty" yaml:"name,omitempty"`
+	CIDRs             []string         `json:"cidrs,omitempty" yaml:"cidrs,omitempty"`
+	IPs               []string         `json:"ips,omitempty" yaml:"ips,omitempty"`
+	MACs              []string         `json:"macs,omitempty" yaml:"macs,omitempty"`
+	Blocklist         *BlocklistConfig `json:"blocklist,omitempty" yaml:"blocklist,omitempty"`
+	Nameservers       []*NetPort       `json:"nameservers,omitempty" yaml:"nameservers,omitempty"`
+	Upstream          *UpstreamConfig  `json:"upstream,omitempty" yaml:"upstream,omitempty"`
+	DisableForwarding bool             `json:"disableForwarding,omitempty" yaml:"disableForwarding,omitempty"`
+	LocalDomains      []string         `json:"localDomains,omitempty" yaml:"localDomains,omitempty"`
+}
+
+// Clone return copy
+func (t *ClientGroupConfig) Clone() *ClientGroupConfig {
+	c := &ClientGroupConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// AddNameservers adds the specified nameservers to the group
+func (t *ClientGroupConfig) AddNameservers(nameservers ...*NetPort) *ClientGroupConfig {
+	for _, v := range nameservers {
+		t.Nameservers = append(t.Nameservers, v)
+	}
+	return t
+}
+
+// ViewConfig is a split horizon view with its own domains. A query is answered
+// from the first view where the client IP is in CIDRs and the query arrived on
+// one of the Listeners, a view without CIDRs or Listeners matches any client or
+// listener respectively. Queries that do not match a view are answered from the
+// global domains.
+//
+// The domains of the Static and Unifi providers of the view replace global
+// domains with the same name, the other global domains are also answered in the
+// view. A listener matches on its port, and on its IP and proto if set.
+type ViewConfig struct {
+	Name      string        `json:"name,omitempty" yaml:"name,omitempty"`
+	CIDRs     []string      `json:"cidrs,omitempty" yaml:"cidrs,omitempty"`
+	Listeners []*NetPort    `json:"listeners,omitempty" yaml:"listeners,omitempty"`
+	Static    *StaticConfig `json:"static,omitempty" yaml:"static,omitempty"`
+	Unifi     *UnifiConfig  `json:"unifiConfig,omitempty" yaml:"unifiConfig,omitempty"`
+}
+
+// Clone return copy
+func (t *ViewConfig) Clone() *ViewConfig {
+	c := &ViewConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// AddListeners adds the specified listeners to the view
+func (t *ViewConfig) AddListeners(listeners ...*NetPort) *ViewConfig {
+	for _, v := range listeners {
+		t.Listeners = append(t.Listeners, v)
+	}
+	return t
+}
+
+// AccessConfig is the access control for queries. Recursion applies to names
+// that are forwarded to nameservers and Local to names that are answered from
+// local domains. Clients that are not allowed are REFUSED. If a rule is not set
+// every client is allowed.
+type AccessConfig struct {
+	Recursion *ACLConfig `json:"recursion,omitempty" yaml:"recursion,omitempty"`
+	Local     *ACLConfig `json:"local,omitempty" yaml:"local,omitempty"`
+}
+
+// Clone return copy
+func (t *AccessConfig) Clone() *AccessConfig {
+	c := &AccessConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// ACLConfig is a list of CIDRs or IPs that are allowed and denied. A client
+// that is denied is not allowed even if it is also allowed. If Allow is empty
+// every client that is not denied is allowed.
+type ACLConfig struct {
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+}
+
+// Clone return copy
+func (t *ACLConfig) Clone() *ACLConfig {
+	c := &ACLConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// CacheStats are the counters for the cache of forwarded responses
+type CacheStats struct {
+	Entries    int    `json:"entries" yaml:"entries"`
+	MaxEntries int    `json:"maxEntries" yaml:"maxEntries"`
+	Hits       uint64 `json:"hits" yaml:"hits"`
+	Misses     uint64 `json:"misses" yaml:"misses"`
+	Insertions uint64 `json:"insertions" yaml:"insertions"`
+	Evictions  uint64 `json:"evictions" yaml:"evictions"`
+	Expired    uint64 `json:"expired" yaml:"expired"`
+	Stale      uint64 `json:"stale" yaml:"stale"`
+	Prefetches uint64 `json:"prefetches" yaml:"prefetches"`
+}
+
+// SOAConfig is the config used to synthesize the SOA and NS records for each
+// locally served domain. Mname and Rname may be relative to the domain or fully
+// qualified with a trailing dot. If Serial is not set the start time is used.
+// The serial is incremented each time a provider refresh changes the records.
+type SOAConfig struct {
+	Mname   string        `json:"mname,omitempty" yaml:"mname,omitempty"`
+	Rname   string        `json:"rname,omitempty" yaml:"rname,omitempty"`
+	Serial  uint32        `json:"serial,omitempty" yaml:"serial,omitempty"`
+	Refresh time.Duration `json:"refresh,omitempty" yaml:"refresh,omitempty"`
+	Retry   time.Duration `json:"retry,omitempty" yaml:"retry,omitempty"`
+	Expire  time.Duration `json:"expire,omitempty" yaml:"expire,omitempty"`
+	Minttl  time.Duration `json:"minttl,omitempty" yaml:"minttl,omitempty"`
+}
+
+// Clone return copy
+func (t *SOAConfig) Clone() *SOAConfig {
+	c := &SOAConfig{}
+	copier.Copy(&c, &t)
+	return c
+}
+
+// HttpConfig is the config for HTTP servers. If the listener has a CertFile and
+// KeyFile the server uses HTTPS. If DoH is true DNS over HTTPS queries are
+// answered on /dns-query.
 type HttpConfig struct {
 	Listener *NetPort `json:"listener,omitempty" yaml:"listener,omitempty"`
 	Enabled  bool     `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	DoH      bool     `json:"doh,omitempty" yaml:"doh,omitempty"`
 }
 
 // Clone return copy
@@ -178,6 +746,30 @@ func (t *Config) AddNameservers(nameservers ...*NetPort) *Config {
 	return t
 }
 
+// AddForwarders adds the specified conditional forwarders to the config
+func (t *Config) AddForwarders(forwarders ...*ForwarderConfig) *Config {
+	for _, v := range forwarders {
+		t.Forwarders = append(t.Forwarders, v)
+	}
+	return t
+}
+
+// AddClientGroups adds the specified client groups to the config
+func (t *Config) AddClientGroups(groups ...*ClientGroupConfig) *Config {
+	for _, v := range groups {
+		t.ClientGroups = append(t.ClientGroups, v)
+	}
+	return t
+}
+
+// AddViews adds the specified views to the config
+func (t *Config) AddViews(views ...*ViewConfig) *Config {
+	for _, v := range views {
+		t.Views = append(t.Views, v)
+	}
+	return t
+}
+
 // AddNameserver adds the specified nameserver to the config
 func (t *Config) AddListeners(listeners ...*NetPort) *Config {
 	for _, v := range listeners {
@@ -193,6 +785,7 @@ type UnifiConfig struct {
 	Enabled    bool          `json:"enabled,omitempty" yaml:"enabled,omitempty"`
 	Domain     string        `json:"domain,omitempty" yaml:"domain,omitempty"`
 	IgnoreMacs []string      `json:"ignoreMacs,omitempty" yaml:"ignoreMacs,omitempty"`
+	TTL        time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
 }
 
 // Clone return copy
@@ -238,8 +831,10 @@ func (t *StaticConfig) Clone() *StaticConfig {
 // not set then a default domain will be used. The same default domain will be used
 // of CNAME target domains if not configured. It is not normally required to add PTR
 // records as they will be automatically generated when the A record is created.
+// The TTL is used for records in the domain that do not have their own TTL.
 type Domain struct {
 	Domain  string        `json:"domain,omitempty" yaml:"dnsDomain,omitempty"`
+	TTL     time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
 	Records DomainRecords `json:"records,omitempty" yaml:"records,omitempty"`
 }
 
@@ -255,6 +850,10 @@ type DomainRecords struct {
 	AAAARecords  []*ARecord     `json:"aaaRecords,omitempty" yaml:"aaaRecords,omitempty"`
 	CnameRecords []*CNameRecord `json:"cnameRecords,omitempty" yaml:"cnameRecords,omitempty"`
 	PtrRecords   []*PTRrecord   `json:"ptrRecords,omitempty" yaml:"ptrRecords,omitempty"`
+	MxRecords    []*MXRecord    `json:"mxRecords,omitempty" yaml:"mxRecords,omitempty"`
+	TxtRecords   []*TXTRecord   `json:"txtRecords,omitempty" yaml:"txtRecords,omitempty"`
+	SrvRecords   []*SRVRecord   `json:"srvRecords,omitempty" yaml:"srvRecords,omitempty"`
+	NsRecords    []*NSRecord    `json:"nsRecords,omitempty" yaml:"nsRecords,omitempty"`
 }
 
 // AddDomain is a convenience function that adds the specified Domaain to the StaticConfig
@@ -295,3 +894,35 @@ func (t *DomainRecords) AddCNameRecords(records ...*CNameRecord) *DomainRecords
 	}
 	return t
 }
+
+// AddMXRecords is a convenience that adds the specified MXRecord to the Domain
+func (t *DomainRecords) AddMXRecords(records ...*MXRecord) *DomainRecords {
+	for _, v := range records {
+		t.MxRecords = append(t.MxRecords, v)
+	}
+	return t
+}
+
+// AddTXTRecords is a convenience that adds the specified TXTRecord to the Domain
+func (t *DomainRecords) AddTXTRecords(records ...*TXTRecord) *DomainRecords {
+	for _, v := range records {
+		t.TxtRecords = append(t.TxtRecords, v)
+	}
+	return t
+}
+
+// AddSRVRecords is a convenience that adds the specified SRVRecord to the Domain
+func (t *DomainRecords) AddSRVRecords(records ...*SRVRecord) *DomainRecords {
+	for _, v := range records {
+		t.SrvRecords = append(t.SrvRecords, v)
+	}
+	return t
+}
+
+// AddNSRecords is a convenience that adds the specified NSRecord to the Domain
+func (t *DomainRecords) AddNSRecords(records ...*NSRecord) *DomainRecords {
+	for _, v := range records {
+		t.NsRecords = append(t.NsRecords, v)
+	}
+	return t
+}
@@ -63,6 +63,10 @@ func (t *Client) GetRefreshDuration() time.Duration {
 	return t.config.Refresh
 }
 
+func (t *Client) GetTTL() time.Duration {
+	return t.config.TTL
+}
+
 func (t *Client) GetDomainName() string {
 	return t.domainname
 }
@@ -126,6 +130,7 @@ func (t *Client) GetRecords() (*Records, error) {
 				Domain:   t.domainname,
 				IP:       ip,
 				SRC:      source + ":unifi-client",
+				MAC:      client.Mac,
 			}
 
 			switch iptype {
@@ -243,6 +248,7 @@ func (t *Client) GetRecords() (*Records, error) {
 			Domain:   t.domainname,
 			IP:       device.IP,
 			SRC:      source + ":unifi-device",
+			MAC:      device.Mac,
 		}
 
 		records.AddARecords(a)
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// certificateCheckInterval is how often the files are checked for changes
+	certificateCheckInterval = time.Second * 10
+)
+
+// Certificate is a certificate and key pair loaded from files. The files are
+// checked for changes during handshakes and reloaded so that certificates can
+// be rotated without a restart. If a reload fails the current certificate is
+// kept.
+type Certificate struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+// NewCertificate returns the certificate loaded from the files
+func NewCertificate(certFile, keyFile string) (*Certificate, error) {
+
+	if certFile == "" {
+		return nil, fmt.Errorf("CertFile is required")
+	}
+
+	if keyFile == "" {
+		return nil, fmt.Errorf("KeyFile is required")
+	}
+
+	t := &Certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	modTime, err := t.getModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// getModTime returns the latest modification time of the files
+func (t *Certificate) getModTime() (time.Time, error) {
+
+	var modTime time.Time
+
+	for _, file := range []string{t.certFile, t.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+func (t *Certificate) load(modTime time.Time) error {
+
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return err
+	}
+
+	t.cert = &cert
+	t.modTime = modTime
+	t.checked = time.Now()
+	return nil
+}
+
+// GetCertificate is for tls.Config and returns the current certificate
+func (t *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if time.Since(t.checked) < certificateCheckInterval {
+		return t.cert, nil
+	}
+
+	t.checked = time.Now()
+
+	modTime, err := t.getModTime()
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Unable to check certificate %s; error is %s", t.certFile, err.Error()))
+		return t.cert, nil
+	}
+
+	if modTime.Equal(t.modTime) {
+		return t.cert, nil
+	}
+
+	if err := t.load(modTime); err != nil {
+		zap.L().Error(fmt.Sprintf("Unable to reload certificate %s; error is %s", t.certFile, err.Error()))
+		return t.cert, nil
+	}
+
+	zap.L().Info(fmt.Sprintf("Reloaded certificate %s", t.certFile))
+
+	return t.cert, nil
+}
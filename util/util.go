@@ -18,6 +18,31 @@ const (
 
 var space = regexp.MustCompile(`\s+`)
 
+// reverseZonePrefixes are the prefix lengths used for reverse zones of well known
+// ranges. The ranges follow the locally served zones in RFC 6303 and RFC 6598.
+var reverseZonePrefixes = []struct {
+	cidr string
+	bits int
+}{
+	{"10.0.0.0/8", 8},
+	{"172.16.0.0/12", 16},
+	{"192.168.0.0/16", 16},
+	{"100.64.0.0/10", 16},
+	{"169.254.0.0/16", 16},
+	{"127.0.0.0/8", 8},
+	{"192.0.2.0/24", 24},
+	{"198.51.100.0/24", 24},
+	{"203.0.113.0/24", 24},
+	{"fc00::/7", 8},
+	{"fe80::/10", 12},
+	{"2001:db8::/32", 32},
+}
+
+const (
+	defaultReverseZoneBitsV4 = 24
+	defaultReverseZoneBitsV6 = 64
+)
+
 // e.0.0.2.0.0.0.0.0.0.0.0.0.0.0.0.7.0.8.0.f.0.0.4.0.b.8.f.7.0.6.2.ip6.arpa domain name pointer den16s09-in-x0e.1e100.net.
 // e.0.0.2.0.0.0.0.0.0.0.0.0.0.0.0.7.0.8.0.f.0.0.4.0.b.8.f.7.0.6.2.ip6.arpa domain name pointer den16s05-in-x0e.1e100.net.
 
@@ -27,11 +52,14 @@ func GetARPA(ipOrArpa string) (string, error) {
 
 	f := reverse
 
+	// The ARPA may be fully qualified with a trailing dot
+	trimmed := strings.TrimSuffix(ipOrArpa, ".")
+
 	switch {
-	case strings.HasSuffix(ipOrArpa, IP4arpa):
-		search = strings.TrimSuffix(ipOrArpa, IP4arpa)
-	case strings.HasSuffix(ipOrArpa, IP6arpa):
-		search = strings.TrimSuffix(ipOrArpa, IP6arpa)
+	case strings.HasSuffix(trimmed, IP4arpa):
+		search = strings.TrimSuffix(trimmed, IP4arpa)
+	case strings.HasSuffix(trimmed, IP6arpa):
+		search = strings.TrimSuffix(trimmed, IP6arpa)
 		f = reverse6
 	}
 
@@ -54,6 +82,147 @@ func GetARPA(ipOrArpa string) (string, error) {
 	return addTerm(result), nil
 }
 
+// GetReverseZone returns the reverse zone that the IP or ARPA belongs to. Private
+// ranges use the zones from RFC 6303, otherwise the zone is the /24 for IPv4 and
+// the /64 for IPv6.
+func GetReverseZone(ipOrArpa string) (string, error) {
+
+	ip, err := getARPAIP(ipOrArpa)
+	if err != nil {
+		return "", err
+	}
+
+	bits := defaultReverseZoneBitsV6
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = defaultReverseZoneBitsV4
+	}
+
+	for _, v := range reverseZonePrefixes {
+		_, network, _ := net.ParseCIDR(v.cidr)
+		if network.Contains(ip) {
+			bits = v.bits
+			break
+		}
+	}
+
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, len(ip)*8)), Mask: net.CIDRMask(bits, len(ip)*8)}
+
+	zone, err := getARPA(network.String())
+	if err != nil {
+		return "", err
+	}
+
+	return addTerm(zone), nil
+}
+
+// IsLocallyServed returns true if the IP or ARPA is in one of the private or
+// documentation ranges whose reverse zones are served locally per RFC 6303
+func IsLocallyServed(ipOrArpa string) (bool, error) {
+
+	ip, err := getARPAIP(ipOrArpa)
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range reverseZonePrefixes {
+		_, network, _ := net.ParseCIDR(v.cidr)
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// getARPAIP returns the IP of an IP or the ARPA of a single address
+func getARPAIP(ipOrArpa string) (net.IP, error) {
+
+	arpa, err := GetARPA(ipOrArpa)
+	if err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+
+	if strings.HasSuffix(arpa, IP4arpa+".") {
+		ip = net.ParseIP(reverse(strings.Split(strings.TrimSuffix(arpa, IP4arpa+"."), ".")))
+	} else {
+		ip = net.ParseIP(reverse6(strings.Split(strings.TrimSuffix(arpa, IP6arpa+"."), ".")))
+	}
+
+	if ip == nil {
+		return nil, fmt.Errorf("ARPA %s is not a single address", arpa)
+	}
+
+	return ip, nil
+}
+
+// GetReverseZones returns the reverse zones for the CIDR. Reverse zones are on
+// octet boundaries for IPv4 and nibble boundaries for IPv6 so a CIDR that is not
+// on a boundary is expanded into each of the zones it covers.
+func GetReverseZones(cidr string) ([]string, error) {
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	bits, total := network.Mask.Size()
+
+	step := 8
+	if total == 128 {
+		step = 4
+	}
+
+	zoneBits := bits
+	if zoneBits%step != 0 {
+		zoneBits += step - zoneBits%step
+	}
+
+	if zoneBits-bits > 8 {
+		return nil, fmt.Errorf("CIDR %s expands into too many reverse zones", cidr)
+	}
+
+	var zones []string
+
+	count := 1 << (zoneBits - bits)
+	ip := network.IP
+
+	for i := 0; i < count; i++ {
+
+		zone, err := getARPA((&net.IPNet{IP: ip, Mask: net.CIDRMask(zoneBits, total)}).String())
+		if err != nil {
+			return nil, err
+		}
+
+		zones = append(zones, addTerm(zone))
+		ip = nextNetwork(ip, zoneBits)
+	}
+
+	return zones, nil
+}
+
+// nextNetwork returns the first IP of the network of the same size that follows
+// the network with the IP and prefix bits
+func nextNetwork(ip net.IP, bits int) net.IP {
+
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+
+	// Add one at the last bit of the prefix, carrying into the preceding bytes
+	i := (bits - 1) / 8
+	carry := 1 << (7 - uint((bits-1)%8))
+
+	for ; i >= 0 && carry > 0; i-- {
+		sum := int(next[i]) + carry
+		next[i] = byte(sum)
+		carry = sum >> 8
+	}
+
+	return next
+}
+
 func addTerm(input string) string {
 
 	l := input[len(input)-1:]
@@ -197,6 +366,23 @@ func uitoa(val uint) string {
 	return string(buf[i:])
 }
 
+// IsWildcard returns true if the hostname is a wildcard such as * or *.apps
+func IsWildcard(hostname string) bool {
+	return hostname == "*" || strings.HasPrefix(hostname, "*.")
+}
+
+// ValidateWildcard returns an error if the hostname contains an asterisk that
+// is not the entire leftmost label
+func ValidateWildcard(hostname string) error {
+	if !strings.Contains(hostname, "*") {
+		return nil
+	}
+	if !IsWildcard(hostname) || strings.Count(hostname, "*") > 1 {
+		return fmt.Errorf("Hostname %s is invalid; a wildcard must be the leftmost label", hostname)
+	}
+	return nil
+}
+
 func GetHostname(input string) string {
 	input = strings.ToLower(input)
 	input = space.ReplaceAllString(input, "-")